@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/sdnotify"
+)
+
+// A daemonized child reports on the pipe in this environment variable
+// whether it came up: readyMsg, or why it failed.
+const (
+	readyEnv = "TOKEPING_READY_FD"
+	readyMsg = "READY"
+)
+
+// How long start -d waits for the daemon to come up.
+const startTimeout = 30 * time.Second
+
+// daemonize starts tokeping again in the background, in its own session
+// without a terminal, and waits until it is up or has failed. The child
+// gets the config as an absolute path and runs in the current directory,
+// so relative paths in the config mean the same as in the foreground.
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("daemonize: %w", err)
+	}
+	cfg, err := filepath.Abs(cfgFile)
+	if err != nil {
+		return fmt.Errorf("daemonize: %w", err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("daemonize: %w", err)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("daemonize: open %s: %w", os.DevNull, err)
+	}
+	defer devNull.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("daemonize: %w", err)
+	}
+	defer r.Close()
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, readyEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	proc, err := os.StartProcess(exe, []string{exe, "start", "-c", cfg}, &os.ProcAttr{
+		Dir:   dir,
+		Env:   append(env, readyEnv+"=3"),
+		Files: []*os.File{devNull, devNull, devNull, w},
+		Sys:   &syscall.SysProcAttr{Setsid: true},
+	})
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("daemonize: start process failed: %w", err)
+	}
+
+	msg := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(r)
+		msg <- strings.TrimSpace(string(b))
+	}()
+	select {
+	case m := <-msg:
+		switch m {
+		case readyMsg:
+			fmt.Printf("tokeping daemon started, PID %d\n", proc.Pid)
+			return nil
+		case "":
+			return fmt.Errorf("tokeping daemon (PID %d) exited during startup", proc.Pid)
+		}
+		return errors.New(m)
+	case <-time.After(startTimeout):
+		return fmt.Errorf("tokeping daemon (PID %d) did not come up within %s", proc.Pid, startTimeout)
+	}
+}
+
+// readyPipe returns the pipe to report readiness on when started by
+// daemonize, nil otherwise.
+func readyPipe() *os.File {
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		return nil
+	}
+	os.Unsetenv(readyEnv)
+	// keep it from commands run by the exec probe
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), "ready")
+}
+
+// started tells whoever started the daemon, systemd or start -d, that it
+// is up.
+func started(ready *os.File) {
+	sdnotify.Notify(sdnotify.Ready)
+	if ready != nil {
+		fmt.Fprintln(ready, readyMsg)
+		ready.Close()
+	}
+}
+
+// startFailed reports why the daemon could not start and exits.
+func startFailed(ready *os.File, err error) {
+	if ready != nil {
+		fmt.Fprintln(ready, err)
+		ready.Close()
+	}
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// pidFilePath returns the PID file given with --pid-file, or the one set
+// in the config. The flag lets stop and status work while the config file
+// is broken, and reload find a daemon whose PID file the config doesn't name.
+func pidFilePath(flag string) (string, error) {
+	if flag != "" {
+		return flag, nil
+	}
+	conf, err := config.Load(cfgFile)
+	if err != nil {
+		return "", fmt.Errorf("%w\n(use --pid-file to find the daemon without the config)", err)
+	}
+	if conf.PIDFile == "" {
+		return "", errors.New("no pid_file configured")
+	}
+	return conf.PIDFile, nil
+}
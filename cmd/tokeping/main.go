@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"tokeping/pkg/config"
 	"tokeping/pkg/daemon"
+	"tokeping/pkg/logging"
+	"tokeping/pkg/pidfile"
+	"tokeping/pkg/plugin"
+	"tokeping/pkg/sdnotify"
+	"tokeping/pkg/smokeping"
 	_ "tokeping/plugins/dns"
+	_ "tokeping/plugins/exec"
 	_ "tokeping/plugins/file"
+	_ "tokeping/plugins/http"
 	_ "tokeping/plugins/influxdb"
 	_ "tokeping/plugins/ping"
+	_ "tokeping/plugins/prometheus"
+	_ "tokeping/plugins/tcp"
+	_ "tokeping/plugins/tls"
 	_ "tokeping/plugins/ws"
 	_ "tokeping/plugins/zmq"
 	_ "tokeping/plugins/mtr"
@@ -32,70 +46,378 @@ var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start the tokeping daemon",
 	Run: func(cmd *cobra.Command, args []string) {
-		// Daemonize stuff
-		if daemonize, _ := cmd.Flags().GetBool("daemonize"); daemonize {
-			// 1️⃣ Remove the daemonize flag for the child
-			args := []string{os.Args[0]}
-			for _, a := range os.Args[1:] {
-				if a == "--daemonize" || a == "-d" {
+		if background, _ := cmd.Flags().GetBool("daemonize"); background {
+			if err := daemonize(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+		ready := readyPipe()
+
+		// Load config, and with it the plugins of plugin_dir
+		plugin.EnableLoading()
+		conf, err := config.Load(cfgFile)
+		if err != nil {
+			startFailed(ready, err)
+		}
+
+		if err := logging.Setup(conf.Log); err != nil {
+			startFailed(ready, err)
+		}
+		log := logging.New("main")
+
+		// Write PID file if configured, unless another daemon has it
+		if conf.PIDFile != "" {
+			if err := pidfile.Write(conf.PIDFile); err != nil {
+				startFailed(ready, err)
+			}
+			defer pidfile.Remove(conf.PIDFile)
+		}
+
+		// Create and run daemon
+		d, err := daemon.New(conf)
+		if err != nil {
+			pidfile.Remove(conf.PIDFile)
+			startFailed(ready, err)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+
+		go d.Run(ctx)
+		<-d.Ready()
+		log.Info("started", "pid", os.Getpid(), "config", cfgFile)
+		started(ready)
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info("stopping")
+				sdnotify.Notify(sdnotify.Stopping)
+				d.Stop()
+				return
+			case <-hup:
+				newConf, err := config.Load(cfgFile)
+				if err != nil {
+					log.Error("reload failed, keeping current config", "err", err)
+					continue
+				}
+				if err := logging.Setup(newConf.Log); err != nil {
+					log.Error("reload failed, keeping current config", "err", err)
 					continue
 				}
-				args = append(args, a)
+				log.Info("reloading configuration", "path", cfgFile)
+				sdnotify.Notify(sdnotify.Reloading())
+				d.Reload(newConf)
+				sdnotify.Notify(sdnotify.Ready)
 			}
+		}
+	},
+}
 
-			// 2️⃣ Open /dev/null for stdio
-			devNull, err := os.OpenFile("/dev/null", os.O_RDWR, 0)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "daemonize: open /dev/null: %v\n", err)
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop a running tokeping daemon",
+	Long: `Stop the tokeping daemon recorded in the PID file and wait for it to
+flush its outputs and exit. A stale PID file is removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flag, _ := cmd.Flags().GetString("pid-file")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		path, err := pidFilePath(flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pid, running, err := pidfile.Check(path)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Println("tokeping is not running")
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !running {
+			if err := pidfile.RemoveStale(path); err != nil {
+				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
-			defer devNull.Close()
-
-			// 3️⃣ Spawn a new session
-			attr := &os.ProcAttr{
-				Dir:   ".", // or your desired working dir
-				Env:   os.Environ(),
-				Files: []*os.File{devNull, devNull, devNull},
-				Sys:   &syscall.SysProcAttr{Setsid: true},
+			fmt.Printf("tokeping is not running, removed stale pid file %s (PID %d)\n", path, pid)
+			return
+		}
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to signal PID %d: %v\n", pid, err)
+			os.Exit(1)
+		}
+		deadline := time.Now().Add(timeout)
+		for {
+			// gone or no longer locked once the daemon has exited
+			if _, running, err := pidfile.Check(path); err != nil || !running {
+				break
 			}
-
-			proc, err := os.StartProcess(os.Args[0], args, attr)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "daemonize: start process failed: %v\n", err)
+			if time.Now().After(deadline) {
+				fmt.Fprintf(os.Stderr, "tokeping daemon, PID %d, did not stop within %s\n", pid, timeout)
 				os.Exit(1)
 			}
-			fmt.Printf("tokeping daemon started, PID %d\n", proc.Pid)
-			os.Exit(0)
+			time.Sleep(100 * time.Millisecond)
+		}
+		fmt.Printf("stopped tokeping daemon, PID %d\n", pid)
+	},
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Report whether the tokeping daemon is running",
+	Long: `Report whether the tokeping daemon recorded in the PID file is running.
+The exit status follows the LSB init script convention: 0 if it is
+running, 1 if the PID file is stale, 3 if it is not running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flag, _ := cmd.Flags().GetString("pid-file")
+		path, err := pidFilePath(flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		}
+		pid, running, err := pidfile.Check(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			fmt.Println("tokeping is not running")
+			os.Exit(3)
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(4)
+		case !running:
+			fmt.Printf("tokeping is not running, but pid file %s names PID %d\n", path, pid)
+			os.Exit(1)
 		}
+		fmt.Printf("tokeping is running, PID %d\n", pid)
+	},
+}
 
-		// Load config
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Ask a running tokeping daemon to reload its configuration",
+	Long: `Check the config file, then send SIGHUP to the tokeping daemon
+recorded in the PID file. An invalid config is not sent to the daemon.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// the daemon would refuse it, but only say so in its log
+		if _, err := config.Load(cfgFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		flag, _ := cmd.Flags().GetString("pid-file")
+		path, err := pidFilePath(flag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pid, running, err := pidfile.Check(path)
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "tokeping is not running")
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !running {
+			fmt.Fprintf(os.Stderr, "tokeping is not running, pid file %s is stale (PID %d)\n", path, pid)
+			os.Exit(1)
+		}
+		if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to signal PID %d: %v\n", pid, err)
+			os.Exit(1)
+		}
+		fmt.Printf("sent SIGHUP to tokeping daemon, PID %d\n", pid)
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check a config file and report every problem found",
+	Run: func(cmd *cobra.Command, args []string) {
+		if load, _ := cmd.Flags().GetBool("load-plugins"); load {
+			plugin.EnableLoading()
+		}
 		conf, err := config.Load(cfgFile)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		// without loading them, plugin types are taken on trust
+		if err := plugin.Unchecked(conf); err != nil {
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Fprintln(os.Stderr, "warning:", line)
+			}
+			fmt.Printf("%s: OK, except for the types not checked; --load-plugins checks them\n", cfgFile)
+			return
+		}
+		fmt.Printf("%s: OK\n", cfgFile)
+	},
+}
 
-		// Write PID file if configured
-		if conf.PIDFile != "" {
-			pid := []byte(fmt.Sprintf("%d", os.Getpid()))
-			if err := os.WriteFile(conf.PIDFile, pid, 0644); err != nil {
-				fmt.Fprintf(os.Stderr, "failed to write pid file: %v", err)
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Convert configuration from other tools",
+}
+
+var importSmokepingCmd = &cobra.Command{
+	Use:   "smokeping [smokeping.conf]",
+	Short: "Convert smokeping Targets and Probes into a tokeping config",
+	Long: `Convert a smokeping configuration into a tokeping target tree.
+
+Give either the main smokeping config (with its *** Probes *** and
+*** Targets *** sections and @include files), or separate files with
+--targets and --probes. Anything that cannot be translated is listed on
+stderr with the file and line it came from.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		targets, _ := cmd.Flags().GetString("targets")
+		probes, _ := cmd.Flags().GetString("probes")
+		output, _ := cmd.Flags().GetString("output")
+
+		sp := &smokeping.File{Sections: map[string]*smokeping.Node{}}
+		inputs := []struct{ path, section string }{{targets, "Targets"}, {probes, "Probes"}}
+		if len(args) == 1 {
+			inputs = append([]struct{ path, section string }{{args[0], "General"}}, inputs...)
+		}
+		for _, in := range inputs {
+			if in.path == "" {
+				continue
 			}
+			f, err := smokeping.Parse(in.path, in.section)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			sp.Merge(f)
 		}
 
-		// Create and run daemon
-		d, err := daemon.New(conf)
+		groups, report, err := smokeping.Convert(sp)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		for _, r := range report {
+			fmt.Fprintln(os.Stderr, "not translated:", r)
+		}
+
+		out, err := config.Marshal(&config.Config{Targets: groups})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if output == "-" {
+			os.Stdout.Write(out)
+			return
+		}
+		if err := os.WriteFile(output, out, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("wrote %s (%d untranslated items)\n", output, len(report))
+		if _, err := config.Load(output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Run probes by hand",
+}
+
+var probeOnceCmd = &cobra.Command{
+	Use:   "once [name]",
+	Short: "Run one probe a single time and print its metrics",
+	Long: `Run one probe a single time, with the deadline it gets in the daemon,
+and print its metrics as JSON lines. Outputs are not involved.
+
+Give the name of a probe in the config file, or describe the probe with
+--type, --target and the other flags instead:
+
+  tokeping probe once --type dns --target example.com --resolver 1.1.1.1:53
+
+The exit status is 1 if any metric reports a failure.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		typ, _ := cmd.Flags().GetString("type")
+		var pCfg config.ProbeConfig
+		switch {
+		case len(args) == 1 && typ != "":
+			fmt.Fprintln(os.Stderr, "give either a probe name or --type, not both")
+			os.Exit(1)
+		case len(args) == 1:
+			plugin.EnableLoading()
+			conf, err := config.Load(cfgFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			found := false
+			for _, p := range conf.Probes {
+				if p.Name == args[0] {
+					pCfg, found = p, true
+					break
+				}
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "no probe named %q in %s\n", args[0], cfgFile)
+				os.Exit(1)
+			}
+		case typ != "":
+			f := cmd.Flags()
+			pCfg.Type = typ
+			pCfg.Target, _ = f.GetString("target")
+			pCfg.Name = typ + ":" + pCfg.Target
+			pCfg.Interval, _ = f.GetDuration("interval")
+			pCfg.Resolver, _ = f.GetString("resolver")
+			pCfg.Protocol, _ = f.GetString("protocol")
+			pCfg.DoHURL, _ = f.GetString("doh-url")
+			pCfg.QueryType, _ = f.GetString("query-type")
+			pCfg.Family, _ = f.GetString("family")
+			pCfg.Timeout, _ = f.GetDuration("timeout")
+			pCfg.Pings, _ = f.GetInt("pings")
+			pCfg.Port, _ = f.GetInt("port")
+			if pCfg.Interval <= 0 {
+				fmt.Fprintln(os.Stderr, "--interval must be positive")
+				os.Exit(1)
+			}
+			if err := plugin.ValidateProbe(pCfg); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		default:
+			fmt.Fprintln(os.Stderr, "give a probe name or --type")
+			os.Exit(1)
+		}
+		if debug, _ := cmd.Flags().GetBool("debug"); debug {
+			pCfg.Debug = true
+		}
 
 		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
-
-		go d.Run(ctx)
-		<-ctx.Done()
-		d.Stop()
+		metrics, err := daemon.RunOnce(ctx, pCfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		failed := false
+		for _, m := range metrics {
+			enc.Encode(m)
+			if m.Status != plugin.StatusOK {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
 
@@ -105,7 +427,36 @@ func init() {
 	})
 	rootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "config.yaml", "config file")
 	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(reloadCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(importSmokepingCmd)
+	importSmokepingCmd.Flags().String("targets", "", "smokeping Targets file")
+	importSmokepingCmd.Flags().String("probes", "", "smokeping Probes file")
+	importSmokepingCmd.Flags().StringP("output", "o", "-", "where to write the tokeping config, - for stdout")
 	startCmd.Flags().BoolP("daemonize", "d", false, "Run in background as daemon")
+	validateCmd.Flags().Bool("load-plugins", false, "load the plugins of plugin_dir to check their types")
+	stopCmd.Flags().String("pid-file", "", "PID file of the daemon, instead of the one in the config")
+	stopCmd.Flags().Duration("timeout", 15*time.Second, "how long to wait for the daemon to exit")
+	statusCmd.Flags().String("pid-file", "", "PID file of the daemon, instead of the one in the config")
+	reloadCmd.Flags().String("pid-file", "", "PID file of the daemon, instead of the one in the config")
+	rootCmd.AddCommand(probeCmd)
+	probeCmd.AddCommand(probeOnceCmd)
+	f := probeOnceCmd.Flags()
+	f.String("type", "", "probe type, for a probe not in the config file")
+	f.String("target", "", "probe target")
+	f.Duration("interval", time.Minute, "probe interval, also the deadline of the run")
+	f.String("resolver", "", "dns: host:port of the DNS server")
+	f.String("protocol", "", "dns: udp, tcp, dot or doh; mtr: icmp, udp or tcp")
+	f.String("doh-url", "", "dns: DoH endpoint")
+	f.String("query-type", "", "dns: query type, default A")
+	f.String("family", "", "ipv4 or ipv6, default IPv6 first")
+	f.Duration("timeout", 0, "per-attempt timeout")
+	f.Int("pings", 0, "ping, mtr: packets per round")
+	f.Int("port", 0, "mtr: destination port")
+	f.Bool("debug", false, "log the probe's run at debug level on stderr")
 }
 
 func main() {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"tokeping/pkg/plugin"
+)
+
+// Run as the test binary with TOKEPING_MAIN set, the test process is
+// tokeping itself, so commands can be checked for their exit status.
+func TestMain(m *testing.M) {
+	if os.Getenv("TOKEPING_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// tokeping runs the command line args and returns its stdout and exit
+// status.
+func tokeping(t *testing.T, args ...string) ([]byte, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "TOKEPING_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if err != nil && !errors.As(err, &exit) {
+		t.Fatal(err)
+	}
+	if exit != nil {
+		t.Logf("stderr: %s", stderr.String())
+		return stdout.Bytes(), exit.ExitCode()
+	}
+	return stdout.Bytes(), 0
+}
+
+func TestProbeOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+probes:
+  - {name: up, type: exec, target: check, interval: 1m, command: [echo, "42"]}
+  - {name: down, type: exec, target: check, interval: 1m, command: [sh, -c, "echo 1; exit 2"]}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		probe  string
+		status int
+		value  float64
+	}{
+		{"up", 0, 42},
+		{"down", 1, 1},
+		{"missing", 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.probe, func(t *testing.T) {
+			out, status := tokeping(t, "-c", path, "probe", "once", tt.probe)
+			if status != tt.status {
+				t.Errorf("exit status %d, want %d", status, tt.status)
+			}
+			if tt.probe == "missing" {
+				if len(out) > 0 {
+					t.Errorf("printed %s", out)
+				}
+				return
+			}
+			var m plugin.Metric
+			if err := json.Unmarshal(out, &m); err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+			if m.Probe != tt.probe || m.Fields["value"] != tt.value {
+				t.Errorf("printed %s", out)
+			}
+		})
+	}
+}
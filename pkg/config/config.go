@@ -1,6 +1,7 @@
 package config
 
 import (
+    "os"
     "time"
 
     "github.com/spf13/viper"
@@ -11,9 +12,48 @@ type ProbeConfig struct {
     Type     string        `mapstructure:"type"`
     Target   string        `mapstructure:"target"`
     Interval time.Duration `mapstructure:"interval"`
-    Resolver string        `mapstructure:"resolver,omitempty"`     // host:port of DNS server (for tcp, udp, dot)
-    Protocol string        `mapstructure:"protocol,omitempty"`     // "udp"|"tcp"|"dot"|"doh"
+    Resolver string        `mapstructure:"resolver,omitempty"`     // host:port of DNS server (for udp, tcp, dot)
+    Protocol string        `mapstructure:"protocol,omitempty"`     // dns: "udp"|"tcp"|"dot"|"doh", mtr: "icmp"|"udp"|"tcp"
     DoHURL   string        `mapstructure:"doh_url,omitempty"`      // only for "doh" mode
+    Pings    int           `mapstructure:"pings,omitempty"`        // packets per round: ping default 20, mtr per hop default 5
+    Family   string        `mapstructure:"family,omitempty"`       // "ipv6"|"ipv4", default IPv6 first
+    Timeout  time.Duration `mapstructure:"timeout,omitempty"`      // per-attempt timeout
+    RunTimeout time.Duration `mapstructure:"run_timeout,omitempty"` // whole run, default the interval
+    Jitter   time.Duration `mapstructure:"jitter,omitempty"`       // random delay of up to this before each run
+    Tags     map[string]string `mapstructure:"tags,omitempty"`     // added to every metric
+    Debug    bool          `mapstructure:"debug,omitempty"`        // log this probe's runs at debug level
+
+    // http probe
+    Method       string            `mapstructure:"method,omitempty"`        // default GET
+    Headers      map[string]string `mapstructure:"headers,omitempty"`
+    HTTPVersion  string            `mapstructure:"http_version,omitempty"`  // "1.1"|"2", default negotiated; doh also "3"
+    ExpectStatus []int             `mapstructure:"expect_status,omitempty"` // default any 2xx/3xx
+    ExpectBody   string            `mapstructure:"expect_body,omitempty"`   // substring
+    ExpectRegex  string            `mapstructure:"expect_regex,omitempty"`
+
+    // dns probe
+    QueryType    string   `mapstructure:"query_type,omitempty"`    // A, AAAA, MX, TXT, ..., default A
+    ExpectRcode  string   `mapstructure:"expect_rcode,omitempty"`  // default NOERROR
+    ExpectAnswer []string `mapstructure:"expect_answer,omitempty"` // allowed answers, e.g. addresses
+    EDNSBufSize  int      `mapstructure:"edns_buffer_size,omitempty"` // adds an EDNS0 OPT record
+    DNSSECOK     bool     `mapstructure:"dnssec_ok,omitempty"`        // sets the DO bit, implies EDNS0
+    DNSSEC       bool     `mapstructure:"dnssec,omitempty"`           // validate answers, implies dnssec_ok
+    TrustAnchor  []string `mapstructure:"trust_anchor,omitempty"`     // DS or DNSKEY records, default the root KSK
+    Nameservers  []string `mapstructure:"nameservers,omitempty"`      // soa: servers to compare, default the zone's NS
+    DoHMethod    string   `mapstructure:"doh_method,omitempty"`       // "get"|"post", default get
+    FreshConnection bool  `mapstructure:"fresh_connection,omitempty"` // doh: new connection every query
+
+    // mtr probe
+    Port    int `mapstructure:"port,omitempty"`     // destination port for udp/tcp traces
+    MaxHops int `mapstructure:"max_hops,omitempty"` // default 30
+
+    // tls probe
+    ServerName string `mapstructure:"server_name,omitempty"` // SNI and name to check, default the target host
+    SkipVerify bool   `mapstructure:"skip_verify,omitempty"` // report an untrusted chain or name mismatch without failing
+
+    // exec probe
+    Command []string `mapstructure:"command,omitempty"` // program and arguments, run without a shell
+    Format  string   `mapstructure:"format,omitempty"`  // "number"|"json"|"influx", default number
 }
 
 type OutputConfig struct {
@@ -25,21 +65,66 @@ type OutputConfig struct {
     Org    string `mapstructure:"org,omitempty"`
     Bucket string `mapstructure:"bucket,omitempty"`
     Path   string `mapstructure:"path,omitempty"`
+    // Per-output buffering: queue length and what to do when it is full
+    // ("drop-oldest", "drop-newest" or "block").
+    QueueSize int    `mapstructure:"queue_size,omitempty"`
+    Overflow  string `mapstructure:"overflow,omitempty"`
+}
+
+// LogConfig sets where the daemon logs go and how they look.
+type LogConfig struct {
+    Level  string `mapstructure:"level,omitempty"`  // "debug"|"info"|"warn"|"error", default info
+    Format string `mapstructure:"format,omitempty"` // "logfmt"|"json", default logfmt
+    Output string `mapstructure:"output,omitempty"` // "stderr"|"file"|"syslog"|"journald", default stderr
+    File   string `mapstructure:"file,omitempty"`   // for output file
 }
 
 type Config struct {
-    Probes   []ProbeConfig  `mapstructure:"probes"`
-    Outputs  []OutputConfig `mapstructure:"outputs"`
-    PIDFile  string         `mapstructure:"pid_file,omitempty"`
+    Probes    []ProbeConfig  `mapstructure:"probes"`
+    Targets   []TargetGroup  `mapstructure:"targets,omitempty"`
+    Outputs   []OutputConfig `mapstructure:"outputs"`
+    PIDFile   string         `mapstructure:"pid_file,omitempty"`
+    PluginDir string         `mapstructure:"plugin_dir,omitempty"` // Go plugin .so files, relative to the config file
+    MaxConcurrent int        `mapstructure:"max_concurrent,omitempty"` // probe runs in flight at once, default unlimited
+    Log       LogConfig      `mapstructure:"log,omitempty"`
+
+    file  string
+    lines map[string]int // key path -> line, for error messages
 }
 
+// Load reads and validates the config file at path. Any problems found are
+// returned together as a *ValidationError.
 func Load(path string) (*Config, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{File: path}
+    cfg := Config{file: path, lines: positions(path, data, verr)}
     viper.SetConfigFile(path)
     if err := viper.ReadInConfig(); err != nil {
+        // positions has already reported YAML syntax errors with their line
+        if verr.Err() != nil {
+            return nil, verr
+        }
         return nil, err
     }
-    var cfg Config
-    if err := viper.Unmarshal(&cfg); err != nil {
+    if len(cfg.lines) > 0 || len(verr.Problems) > 0 {
+        err = viper.Unmarshal(&cfg)
+    } else {
+        // no positions (not YAML), let the decoder catch unknown keys
+        err = viper.UnmarshalExact(&cfg)
+    }
+    if err != nil {
+        verr.Add(0, "%v", err)
+        return nil, verr
+    }
+    cfg.flatten(viper.Get("targets"))
+    cfg.check(verr)
+    for _, check := range checks {
+        check(&cfg, verr)
+    }
+    if err := verr.Err(); err != nil {
         return nil, err
     }
     return &cfg, nil
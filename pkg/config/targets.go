@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// TagGroup is the metric tag holding the "/"-separated path of the target
+// groups a probe was defined in.
+const TagGroup = "group"
+
+// TargetGroup is a node of the target tree, the equivalent of a smokeping
+// "+" section. Its defaults are inherited by nested groups and targets,
+// which can override any of them.
+type TargetGroup struct {
+	Name     string        `mapstructure:"name"`
+	Defaults ProbeConfig   `mapstructure:"defaults,omitempty"`
+	Groups   []TargetGroup `mapstructure:"groups,omitempty"`
+	Targets  []ProbeConfig `mapstructure:"targets,omitempty"`
+}
+
+// flatten appends every target in the tree to Probes, with the inherited
+// defaults applied and the group path added as a tag. raw is the targets
+// list as read from the file; it tells which settings were given, so that
+// a target can override an inherited setting with a zero value such as
+// false or "".
+func (c *Config) flatten(raw interface{}) {
+	for i, g := range c.Targets {
+		c.flattenGroup(g, index(raw, i), ProbeConfig{}, nil, fmt.Sprintf("targets[%d]", i))
+	}
+}
+
+func (c *Config) flattenGroup(g TargetGroup, raw interface{}, inherited ProbeConfig, path []string, at string) {
+	defaults := mergeProbe(g.Defaults, keys(field(raw, "defaults")), inherited)
+	path = append(path[:len(path):len(path)], g.Name)
+
+	for i, t := range g.Targets {
+		p := mergeProbe(t, keys(index(field(raw, "targets"), i)), defaults)
+		p.Name = t.Name
+		tags := make(map[string]string, len(p.Tags)+1)
+		for k, v := range p.Tags {
+			tags[k] = v
+		}
+		tags[TagGroup] = strings.Join(path, "/")
+		p.Tags = tags
+
+		// point error messages for the flattened probe at the target
+		src := fmt.Sprintf("%s.targets[%d]", at, i)
+		dst := fmt.Sprintf("probes[%d]", len(c.Probes))
+		for k, line := range c.lines {
+			if k == src || strings.HasPrefix(k, src+".") {
+				c.lines[dst+strings.TrimPrefix(k, src)] = line
+			}
+		}
+		c.Probes = append(c.Probes, p)
+	}
+	for i, sub := range g.Groups {
+		c.flattenGroup(sub, index(field(raw, "groups"), i), defaults, path, fmt.Sprintf("%s.groups[%d]", at, i))
+	}
+}
+
+// mergeProbe returns p with every field not in set taken from defaults.
+// Maps are merged key by key, with p winning.
+func mergeProbe(p ProbeConfig, set map[string]bool, defaults ProbeConfig) ProbeConfig {
+	pv := reflect.ValueOf(&p).Elem()
+	dv := reflect.ValueOf(defaults)
+	for key, sf := range structKeys(pv.Type()) {
+		f, d := pv.FieldByIndex(sf.Index), dv.FieldByIndex(sf.Index)
+		if f.Kind() == reflect.Map && !d.IsNil() {
+			merged := reflect.MakeMap(f.Type())
+			for _, k := range d.MapKeys() {
+				merged.SetMapIndex(k, d.MapIndex(k))
+			}
+			if !f.IsNil() {
+				for _, k := range f.MapKeys() {
+					merged.SetMapIndex(k, f.MapIndex(k))
+				}
+			}
+			f.Set(merged)
+			continue
+		}
+		if !set[key] {
+			f.Set(d)
+		}
+	}
+	return p
+}
+
+// index returns element i of a decoded list, nil if there is none.
+func index(v interface{}, i int) interface{} {
+	if l, ok := v.([]interface{}); ok && i < len(l) {
+		return l[i]
+	}
+	return nil
+}
+
+// field returns the value of key in a decoded map, nil if there is none.
+func field(v interface{}, key string) interface{} {
+	return asMap(v)[key]
+}
+
+// keys returns the keys set in a decoded map.
+func keys(v interface{}) map[string]bool {
+	set := make(map[string]bool)
+	for k := range asMap(v) {
+		set[k] = true
+	}
+	return set
+}
+
+// asMap returns v as a map with lower case keys, as viper treats them.
+func asMap(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			m[strings.ToLower(k)] = x
+		}
+	case map[interface{}]interface{}:
+		for k, x := range v {
+			m[strings.ToLower(fmt.Sprint(k))] = x
+		}
+	}
+	return m
+}
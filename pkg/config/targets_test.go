@@ -0,0 +1,120 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlatten(t *testing.T) {
+	cfg, err := load(t, `
+probes:
+  - name: flat
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+targets:
+  - name: DNS
+    defaults:
+      type: dns
+      interval: 1m
+      dnssec: true
+      pings: 3
+      tags: {team: net, tier: "1"}
+    targets:
+      - name: quad9
+        target: quad9.net
+        resolver: 9.9.9.9:53
+    groups:
+      - name: Cloudflare
+        defaults:
+          resolver: 1.1.1.1:53
+          tags: {tier: "2"}
+        targets:
+          - name: insecure
+            target: example.com
+            dnssec: false
+            pings: 0
+            resolver: ""
+            tags: {extra: x}
+          - name: inherited
+            target: example.org
+            interval: 5m
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ProbeConfig{
+		{Name: "flat", Type: "ping", Target: "192.0.2.1", Interval: 30 * time.Second},
+		{Name: "quad9", Type: "dns", Target: "quad9.net", Interval: time.Minute, Resolver: "9.9.9.9:53", Pings: 3, DNSSEC: true,
+			Tags: map[string]string{"team": "net", "tier": "1", TagGroup: "DNS"}},
+		{Name: "insecure", Type: "dns", Target: "example.com", Interval: time.Minute,
+			Tags: map[string]string{"team": "net", "tier": "2", "extra": "x", TagGroup: "DNS/Cloudflare"}},
+		{Name: "inherited", Type: "dns", Target: "example.org", Interval: 5 * time.Minute, Resolver: "1.1.1.1:53", Pings: 3, DNSSEC: true,
+			Tags: map[string]string{"team": "net", "tier": "2", TagGroup: "DNS/Cloudflare"}},
+	}
+	if len(cfg.Probes) != len(want) {
+		t.Fatalf("got %d probes, want %d", len(cfg.Probes), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(cfg.Probes[i], want[i]) {
+			t.Errorf("probe %d:\ngot  %+v\nwant %+v", i, cfg.Probes[i], want[i])
+		}
+	}
+
+	// errors in flattened probes point at the target
+	for path, line := range map[string]int{
+		"probes[1]":          16,
+		"probes[2].dnssec":   27,
+		"probes[3].interval": 33,
+	} {
+		if got := cfg.Line(path); got != line {
+			t.Errorf("Line(%q) = %d, want %d", path, got, line)
+		}
+	}
+}
+
+func TestMergeProbe(t *testing.T) {
+	defaults := ProbeConfig{
+		Type:     "http",
+		Interval: time.Minute,
+		Debug:    true,
+		Headers:  map[string]string{"Accept": "*/*", "User-Agent": "tokeping"},
+	}
+	tests := []struct {
+		name string
+		p    ProbeConfig
+		set  map[string]bool
+		want ProbeConfig
+	}{
+		{
+			name: "inherit",
+			p:    ProbeConfig{Target: "https://example.com/"},
+			set:  map[string]bool{"target": true},
+			want: ProbeConfig{Type: "http", Target: "https://example.com/", Interval: time.Minute, Debug: true,
+				Headers: map[string]string{"Accept": "*/*", "User-Agent": "tokeping"}},
+		},
+		{
+			name: "override with zero values",
+			p:    ProbeConfig{},
+			set:  map[string]bool{"debug": true, "type": true},
+			want: ProbeConfig{Interval: time.Minute,
+				Headers: map[string]string{"Accept": "*/*", "User-Agent": "tokeping"}},
+		},
+		{
+			name: "merge maps",
+			p:    ProbeConfig{Headers: map[string]string{"Accept": "text/html"}},
+			set:  map[string]bool{"headers": true},
+			want: ProbeConfig{Type: "http", Interval: time.Minute, Debug: true,
+				Headers: map[string]string{"Accept": "text/html", "User-Agent": "tokeping"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeProbe(tt.p, tt.set, defaults); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
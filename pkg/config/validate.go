@@ -0,0 +1,294 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a single thing wrong with a config file. Line is 0 when the
+// position is unknown (non-YAML configs, or type errors from decoding).
+type Problem struct {
+	Line int
+	Msg  string
+}
+
+// ValidationError lists every problem found in a config file.
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	sort.SliceStable(e.Problems, func(i, j int) bool {
+		return e.Problems[i].Line < e.Problems[j].Line
+	})
+	var b strings.Builder
+	for i, p := range e.Problems {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "%s:%d: %s", e.File, p.Line, p.Msg)
+		} else {
+			fmt.Fprintf(&b, "%s: %s", e.File, p.Msg)
+		}
+	}
+	return b.String()
+}
+
+// Add records a problem at line.
+func (e *ValidationError) Add(line int, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, Problem{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Err returns e if it holds any problems, nil otherwise.
+func (e *ValidationError) Err() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+)`)
+
+// positions parses a YAML config file into a map from key path (as used by
+// Config.Line) to line number, reporting syntax errors, duplicate keys and
+// keys that do not correspond to a Config field.
+func positions(path string, data []byte, verr *ValidationError) map[string]int {
+	lines := make(map[string]int)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		return lines
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		line := 0
+		if m := yamlLine.FindStringSubmatch(err.Error()); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		verr.Add(line, "%s", strings.TrimPrefix(err.Error(), "yaml: "))
+		return lines
+	}
+	if len(doc.Content) == 0 {
+		return lines
+	}
+	walk(doc.Content[0], reflect.TypeOf(Config{}), "", lines, verr)
+	return lines
+}
+
+// walk checks node against the mapstructure fields of typ, recording the
+// line of every key it visits.
+func walk(node *yaml.Node, typ reflect.Type, path string, lines map[string]int, verr *ValidationError) {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			verr.Add(node.Line, "%s: expected a mapping", displayPath(path))
+			return
+		}
+		fields := structKeys(typ)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			p := key.Value
+			if path != "" {
+				p = path + "." + key.Value
+			}
+			if first, dup := lines[p]; dup {
+				// the decoder silently keeps only the last one; check that
+				verr.Add(key.Line, "duplicate key %q, first defined at line %d", p, first)
+				forget(lines, p)
+			}
+			lines[p] = key.Line
+			field, ok := fields[strings.ToLower(key.Value)]
+			if !ok {
+				verr.Add(key.Line, "unknown key %q", p)
+				continue
+			}
+			walk(val, field.Type, p, lines, verr)
+		}
+	case reflect.Slice:
+		if typ.Elem().Kind() != reflect.Struct && typ.Elem().Kind() != reflect.Ptr {
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			if node.Tag != "!!null" {
+				verr.Add(node.Line, "%s: expected a list", displayPath(path))
+			}
+			return
+		}
+		for i, item := range node.Content {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			lines[p] = item.Line
+			walk(item, typ.Elem(), p, lines, verr)
+		}
+	}
+}
+
+// forget removes the recorded positions of path and everything below it.
+func forget(lines map[string]int, path string) {
+	for k := range lines {
+		if strings.HasPrefix(k, path+".") || strings.HasPrefix(k, path+"[") {
+			delete(lines, k)
+		}
+	}
+}
+
+// structKeys maps the lower-cased mapstructure key of each field of typ to
+// the field.
+func structKeys(typ reflect.Type) map[string]reflect.StructField {
+	keys := make(map[string]reflect.StructField)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		keys[strings.ToLower(name)] = f
+	}
+	return keys
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// checks holds extra validation registered by other packages, such as the
+// per-type checks of the plugin registry.
+var checks []func(*Config, *ValidationError)
+
+// RegisterCheck adds a validation step run by Load on every decoded config.
+func RegisterCheck(check func(*Config, *ValidationError)) {
+	checks = append(checks, check)
+}
+
+var overflowPolicies = map[string]bool{"": true, "drop-oldest": true, "drop-newest": true, "block": true}
+
+var (
+	logLevels  = map[string]bool{"": true, "debug": true, "info": true, "warn": true, "error": true}
+	logFormats = map[string]bool{"": true, "logfmt": true, "json": true}
+	logOutputs = map[string]bool{"": true, "stderr": true, "file": true, "syslog": true, "journald": true}
+)
+
+// check performs the type-independent checks on a decoded config.
+func (c *Config) check(verr *ValidationError) {
+	seen := make(map[string]int)
+	for i, p := range c.Probes {
+		at := fmt.Sprintf("probes[%d]", i)
+		line := c.Line(at)
+		who := fmt.Sprintf("probe %d", i+1)
+		if p.Name == "" {
+			verr.Add(line, "%s: missing name", who)
+		} else {
+			who = fmt.Sprintf("probe %q", p.Name)
+			if first, dup := seen[p.Name]; dup {
+				verr.Add(line, "%s: duplicate name, first defined at line %d", who, first)
+			} else {
+				seen[p.Name] = line
+			}
+		}
+		if p.Type == "" {
+			verr.Add(line, "%s: missing type", who)
+		}
+		if p.Target == "" {
+			verr.Add(line, "%s: missing target", who)
+		}
+		if p.Interval <= 0 {
+			verr.Add(c.lineOr(at+".interval", line), "%s: interval must be positive, got %s", who, p.Interval)
+		}
+		if p.Timeout < 0 {
+			verr.Add(c.lineOr(at+".timeout", line), "%s: timeout must not be negative", who)
+		}
+		if p.RunTimeout < 0 {
+			verr.Add(c.lineOr(at+".run_timeout", line), "%s: run_timeout must not be negative", who)
+		}
+		if p.Jitter < 0 || (p.Interval > 0 && p.Jitter >= p.Interval) {
+			verr.Add(c.lineOr(at+".jitter", line), "%s: jitter must be between 0 and the interval", who)
+		} else if p.RunTimeout > 0 && p.Jitter >= p.RunTimeout {
+			// the jitter comes out of the run's deadline
+			verr.Add(c.lineOr(at+".jitter", line), "%s: jitter must be shorter than run_timeout", who)
+		}
+		switch p.Family {
+		case "", "ipv6", "ipv4":
+		default:
+			verr.Add(c.lineOr(at+".family", line), "%s: family must be ipv6 or ipv4, got %q", who, p.Family)
+		}
+	}
+
+	seen = make(map[string]int)
+	for i, o := range c.Outputs {
+		at := fmt.Sprintf("outputs[%d]", i)
+		line := c.Line(at)
+		who := fmt.Sprintf("output %d", i+1)
+		if o.Name == "" {
+			verr.Add(line, "%s: missing name", who)
+		} else {
+			who = fmt.Sprintf("output %q", o.Name)
+			if first, dup := seen[o.Name]; dup {
+				verr.Add(line, "%s: duplicate name, first defined at line %d", who, first)
+			} else {
+				seen[o.Name] = line
+			}
+		}
+		if o.Type == "" {
+			verr.Add(line, "%s: missing type", who)
+		}
+		if o.QueueSize < 0 {
+			verr.Add(c.lineOr(at+".queue_size", line), "%s: queue_size must not be negative", who)
+		}
+		if !overflowPolicies[o.Overflow] {
+			verr.Add(c.lineOr(at+".overflow", line), "%s: overflow must be drop-oldest, drop-newest or block, got %q", who, o.Overflow)
+		}
+	}
+
+	if c.MaxConcurrent < 0 {
+		verr.Add(c.Line("max_concurrent"), "max_concurrent must not be negative")
+	}
+
+	if !logLevels[c.Log.Level] {
+		verr.Add(c.lineOr("log.level", c.Line("log")), "log level must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	if !logFormats[c.Log.Format] {
+		verr.Add(c.lineOr("log.format", c.Line("log")), "log format must be logfmt or json, got %q", c.Log.Format)
+	}
+	if !logOutputs[c.Log.Output] {
+		verr.Add(c.lineOr("log.output", c.Line("log")), "log output must be stderr, file, syslog or journald, got %q", c.Log.Output)
+	}
+	if c.Log.Output == "file" && c.Log.File == "" {
+		verr.Add(c.lineOr("log.output", c.Line("log")), "log output file needs log.file to be set")
+	}
+}
+
+// Line returns the line a key path such as "probes[2].interval" was found
+// on, or 0 if unknown.
+func (c *Config) Line(path string) int {
+	return c.lines[path]
+}
+
+func (c *Config) lineOr(path string, fallback int) int {
+	if l := c.Line(path); l > 0 {
+		return l
+	}
+	return fallback
+}
+
+// File returns the path the config was loaded from.
+func (c *Config) File() string {
+	return c.file
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// load writes yaml to a config file and loads it.
+func load(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+// problems returns the problems reported by Load.
+func problems(t *testing.T, err error) []Problem {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %T (%v), want *ValidationError", err, err)
+	}
+	return verr.Problems
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []Problem
+	}{
+		{
+			name: "valid",
+			yaml: `
+probes:
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+outputs:
+  - name: out
+    type: file
+`,
+		},
+		{
+			name: "unknown keys",
+			yaml: `
+probes:
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+    resovler: 192.0.2.53
+log:
+  colour: red
+`,
+			want: []Problem{
+				{7, `unknown key "probes[0].resovler"`},
+				{9, `unknown key "log.colour"`},
+			},
+		},
+		{
+			name: "duplicate key",
+			yaml: `
+probes:
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+    interval: 60s
+`,
+			want: []Problem{{7, `duplicate key "probes[0].interval", first defined at line 6`}},
+		},
+		{
+			name: "missing and invalid settings",
+			yaml: `
+probes:
+  - name: a
+    interval: 0s
+    family: ipx
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+outputs:
+  - type: file
+    overflow: drop-all
+max_concurrent: -1
+`,
+			want: []Problem{
+				{3, `probe "a": missing type`},
+				{3, `probe "a": missing target`},
+				{4, `probe "a": interval must be positive, got 0s`},
+				{5, `probe "a": family must be ipv6 or ipv4, got "ipx"`},
+				{6, `probe "a": duplicate name, first defined at line 3`},
+				{11, "output 1: missing name"},
+				{12, `output 1: overflow must be drop-oldest, drop-newest or block, got "drop-all"`},
+				{13, "max_concurrent must not be negative"},
+			},
+		},
+		{
+			name: "jitter longer than run_timeout",
+			yaml: `
+probes:
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 60s
+    run_timeout: 10s
+    jitter: 20s
+`,
+			want: []Problem{{8, `probe "a": jitter must be shorter than run_timeout`}},
+		},
+		{
+			name: "log settings",
+			yaml: `
+log:
+  level: loud
+  format: xml
+  output: file
+`,
+			want: []Problem{
+				{3, `log level must be debug, info, warn or error, got "loud"`},
+				{4, `log format must be logfmt or json, got "xml"`},
+				{5, "log output file needs log.file to be set"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.yaml)
+			got := problems(t, err)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got problems\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLine(t *testing.T) {
+	cfg, err := load(t, `
+pid_file: /run/tokeping.pid
+probes:
+  - name: a
+    type: ping
+    target: 192.0.2.1
+    interval: 30s
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int{
+		"pid_file":           2,
+		"probes":             3,
+		"probes[0]":          4,
+		"probes[0].interval": 7,
+		"outputs":            0,
+	} {
+		if got := cfg.Line(path); got != want {
+			t.Errorf("Line(%q) = %d, want %d", path, got, want)
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := load(t, "pid_file: a\nprobes:\n\t- name: a\n")
+	got := problems(t, err)
+	if len(got) != 1 || got[0].Line != 3 {
+		t.Errorf("got %v, want one problem on line 3", got)
+	}
+}
+
+func TestWrongShape(t *testing.T) {
+	_, err := load(t, "probes:\n  name: a\n")
+	for _, p := range problems(t, err) {
+		if p == (Problem{2, "probes: expected a list"}) {
+			return
+		}
+	}
+	t.Errorf("got %v, want probes: expected a list on line 2", err)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Marshal renders cfg as YAML that Load accepts, using the same key names.
+// Zero-valued settings are left out.
+func Marshal(cfg *Config) ([]byte, error) {
+	node := encode(reflect.ValueOf(*cfg))
+	var b strings.Builder
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// encode converts v into a YAML node keyed by mapstructure tags.
+func encode(v reflect.Value) *yaml.Node {
+	switch {
+	case v.Type() == durationType:
+		return scalar(formatDuration(time.Duration(v.Int())), "!!str")
+	case v.Kind() == reflect.Struct:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+			if f.PkgPath != "" || name == "" || name == "-" || v.Field(i).IsZero() {
+				continue
+			}
+			n.Content = append(n.Content, scalar(name, "!!str"), encode(v.Field(i)))
+		}
+		return n
+	case v.Kind() == reflect.Slice:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		if v.Type().Elem().Kind() != reflect.Struct {
+			n.Style = yaml.FlowStyle
+		}
+		for i := 0; i < v.Len(); i++ {
+			n.Content = append(n.Content, encode(v.Index(i)))
+		}
+		return n
+	case v.Kind() == reflect.Map:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			n.Content = append(n.Content, scalar(k, "!!str"), encode(v.MapIndex(reflect.ValueOf(k))))
+		}
+		return n
+	case v.Kind() == reflect.String:
+		return scalar(v.String(), "!!str")
+	case v.Kind() == reflect.Bool:
+		return scalar(fmt.Sprint(v.Bool()), "!!bool")
+	default:
+		return scalar(fmt.Sprint(v.Interface()), "!!int")
+	}
+}
+
+func scalar(value, tag string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+}
+
+// formatDuration writes d the way a person would, "5m" rather than "5m0s".
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -2,80 +2,331 @@ package daemon
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"reflect"
+	"sync"
+	"time"
 
 	"tokeping/pkg/config"
+	"tokeping/pkg/logging"
 	"tokeping/pkg/plugin"
+	"tokeping/pkg/stats"
 )
 
-type Daemon struct {
-	cfg    *config.Config
-	outCh  chan plugin.Metric
-	ctx    context.Context
+var log = logging.New("daemon")
+
+// How long Stop waits for outputs to flush their queues.
+const drainTimeout = 5 * time.Second
+
+// runningProbe is a probe goroutine together with the config it was built
+// from, so a reload can tell whether it needs restarting.
+type runningProbe struct {
+	cfg    config.ProbeConfig
 	cancel context.CancelFunc
 }
 
+// builtProbe is a probe constructed ahead of apply, or the reason it
+// could not be.
+type builtProbe struct {
+	cfg   config.ProbeConfig
+	probe plugin.Probe
+	err   error
+}
+
+// reload is a new config together with the probes built for it.
+type reload struct {
+	cfg   *config.Config
+	built map[string]*builtProbe
+}
+
+type Daemon struct {
+	cfg      *config.Config
+	outCh    chan plugin.Metric
+	reloadCh chan reload
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	ready    chan struct{} // closed once the outputs and probes are started
+
+	// owned by the Run goroutine; mu guards reads from other goroutines
+	mu      sync.Mutex
+	probes  map[string]*runningProbe
+	outputs map[string]*outputQueue
+	limit   *limiter // probe runs in flight
+}
+
 func New(cfg *config.Config) (*Daemon, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Daemon{
-		cfg:    cfg,
-		outCh:  make(chan plugin.Metric, 100),
-		ctx:    ctx,
-		cancel: cancel,
+		cfg:      cfg,
+		outCh:    make(chan plugin.Metric, 100),
+		reloadCh: make(chan reload),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		probes:   make(map[string]*runningProbe),
+		outputs:  make(map[string]*outputQueue),
+		limit:    newLimiter(),
 	}, nil
 }
 
 func (d *Daemon) Run(parent context.Context) {
+	defer close(d.done)
 	go func() {
 		<-parent.Done()
 		d.cancel()
 	}()
 
-	outputs := []plugin.Output{}
-	for _, o := range d.cfg.Outputs {
-		out, err := plugin.NewOutput(o)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "⚠️  output %q failed to register: %v\n", o.Name, err)
+	d.apply(d.cfg, d.build(d.cfg))
+	close(d.ready)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			d.drain()
+			return
+		case r := <-d.reloadCh:
+			d.apply(r.cfg, r.built)
+		case m := <-d.outCh:
+			rp, ok := d.probes[m.Probe]
+			if !ok {
+				// the last run of a probe a reload removed
+				continue
+			}
+			addTags(&m, rp.cfg.Tags)
+			stats.ProbeResults.Inc(m.Probe)
+			if m.Status != plugin.StatusOK {
+				stats.ProbeErrors.Inc(m.Probe)
+			}
+			for _, q := range d.outputs {
+				q.push(m)
+			}
+		}
+	}
+}
+
+// addTags copies the configured tags onto m. Tags set by the probe itself
+// take precedence.
+func addTags(m *plugin.Metric, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if m.Tags == nil {
+		m.Tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		if _, ok := m.Tags[k]; !ok {
+			m.Tags[k] = v
+		}
+	}
+}
+
+// Reload replaces the running configuration. Probes and outputs are matched
+// by name; only those that were added, removed or changed are restarted.
+// The new probes are built on the caller's goroutine, so metrics keep
+// flowing while their constructors look up names.
+func (d *Daemon) Reload(cfg *config.Config) {
+	select {
+	case d.reloadCh <- reload{cfg: cfg, built: d.build(cfg)}:
+	case <-d.ctx.Done():
+	}
+}
+
+// build constructs the probes of cfg that are not already running with
+// the same config, without holding d.mu.
+func (d *Daemon) build(cfg *config.Config) map[string]*builtProbe {
+	d.mu.Lock()
+	running := make(map[string]config.ProbeConfig, len(d.probes))
+	for name, rp := range d.probes {
+		running[name] = rp.cfg
+	}
+	d.mu.Unlock()
+
+	built := make(map[string]*builtProbe)
+	for _, p := range cfg.Probes {
+		if _, dup := built[p.Name]; dup {
 			continue
 		}
-		fmt.Printf("➡️  starting output %q (type=%s)\n", o.Name, o.Type)
-		if err := out.Start(); err != nil {
-			fmt.Fprintf(os.Stderr, "⚠️  output %q Start() error: %v\n", o.Name, err)
+		if rc, ok := running[p.Name]; ok && reflect.DeepEqual(rc, p) {
+			continue
 		}
-		outputs = append(outputs, out)
+		pr, err := plugin.NewProbe(p)
+		built[p.Name] = &builtProbe{cfg: p, probe: pr, err: err}
 	}
+	return built
+}
+
+// apply brings the running outputs and probes in line with cfg, starting
+// the probes in built. Outputs that are removed or changed are stopped
+// first, all at once and without holding d.mu, so a changed output can
+// take over its old listen address.
+func (d *Daemon) apply(cfg *config.Config, built map[string]*builtProbe) {
+	d.mu.Lock()
+	d.cfg = cfg
+	d.limit.setMax(cfg.MaxConcurrent)
 
-	for _, pCfg := range d.cfg.Probes {
-		pr, err := plugin.NewProbe(pCfg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "⚠️ probe %q failed to register: %v\n", pCfg.Name, err)
+	wantOutputs := make(map[string]config.OutputConfig, len(cfg.Outputs))
+	for _, o := range cfg.Outputs {
+		if _, dup := wantOutputs[o.Name]; dup {
+			log.Warn("duplicate output name, ignoring", "output", o.Name)
+			continue
+		}
+		wantOutputs[o.Name] = o
+	}
+	var stopping []*outputQueue
+	for name, q := range d.outputs {
+		if o, ok := wantOutputs[name]; ok && reflect.DeepEqual(o, q.cfg) {
 			continue
 		}
-		// <-- add your debug here:
-		fmt.Fprintf(os.Stderr,
-			"🔍 Loaded probe: name=%q, type=%q, target=%q\n",
-			pr.Name(), pCfg.Type, pCfg.Target,
-		)
+		log.Info("stopping output", "output", name)
+		q.close()
+		stopping = append(stopping, q)
+		delete(d.outputs, name)
+	}
+	d.mu.Unlock()
+	wait(stopping)
 
-		go pr.Run(d.ctx, d.outCh)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, o := range cfg.Outputs {
+		if _, ok := d.outputs[o.Name]; ok || !reflect.DeepEqual(wantOutputs[o.Name], o) {
+			continue
+		}
+		d.startOutput(o)
 	}
 
-	for {
+	wantProbes := make(map[string]config.ProbeConfig, len(cfg.Probes))
+	for _, p := range cfg.Probes {
+		if _, dup := wantProbes[p.Name]; dup {
+			log.Warn("duplicate probe name, ignoring", "probe", p.Name)
+			continue
+		}
+		wantProbes[p.Name] = p
+	}
+	for name, rp := range d.probes {
+		if p, ok := wantProbes[name]; ok && reflect.DeepEqual(p, rp.cfg) {
+			continue
+		}
+		log.Info("stopping probe", "probe", name)
+		rp.cancel()
+		delete(d.probes, name)
+		reason := "removed"
+		if _, ok := wantProbes[name]; ok {
+			reason = "changed"
+		}
+		d.stopped(rp.cfg, reason)
+	}
+	for _, p := range cfg.Probes {
+		if _, ok := d.probes[p.Name]; ok || !reflect.DeepEqual(wantProbes[p.Name], p) {
+			continue
+		}
+		b := built[p.Name]
+		if b == nil || !reflect.DeepEqual(b.cfg, p) {
+			// a probe stopped by a reload in between
+			pr, err := plugin.NewProbe(p)
+			b = &builtProbe{cfg: p, probe: pr, err: err}
+		}
+		d.startProbe(b)
+	}
+}
+
+// stopped tells the outputs that a reload stopped probe p, so they can
+// drop what they keep of it.
+func (d *Daemon) stopped(p config.ProbeConfig, reason string) {
+	m := plugin.NewMetric(p.Name, p.Type)
+	m.Tags[plugin.TagEvent] = plugin.EventProbeStopped
+	m.Tags[plugin.TagTarget] = p.Target
+	m.Text = map[string]string{"reason": reason}
+	addTags(&m, p.Tags)
+	for _, q := range d.outputs {
+		q.push(m)
+	}
+}
+
+func (d *Daemon) startOutput(o config.OutputConfig) {
+	out, err := plugin.NewOutput(o)
+	if err != nil {
+		log.Error("output failed to register", "output", o.Name, "err", err)
+		return
+	}
+	q, err := newOutputQueue(o, out)
+	if err != nil {
+		log.Error("output failed to start", "output", o.Name, "err", err)
+		return
+	}
+	log.Info("starting output", "output", o.Name, "type", o.Type)
+	if err := out.Start(); err != nil {
+		log.Error("output failed to start", "output", o.Name, "err", err)
+	}
+	go q.run()
+	d.outputs[o.Name] = q
+}
+
+func (d *Daemon) startProbe(b *builtProbe) {
+	pCfg, pr := b.cfg, b.probe
+	if b.err != nil {
+		log.Error("probe failed to register", "probe", pCfg.Name, "err", b.err)
+		return
+	}
+	log.Info("starting probe", "probe", pr.Name(), "type", pCfg.Type, "target", pCfg.Target)
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.probes[pCfg.Name] = &runningProbe{cfg: pCfg, cancel: cancel}
+	go d.schedule(ctx, pCfg, pr)
+}
+
+// drain closes every output queue and waits, up to drainTimeout, for the
+// outputs to flush and stop.
+func (d *Daemon) drain() {
+	d.mu.Lock()
+	var closed []*outputQueue
+	for _, q := range d.outputs {
+		q.close()
+		closed = append(closed, q)
+	}
+	d.mu.Unlock()
+	wait(closed)
+}
+
+// wait blocks until the closed queues have drained, or drainTimeout has
+// passed for all of them together.
+func wait(queues []*outputQueue) {
+	deadline := time.After(drainTimeout)
+	for _, q := range queues {
 		select {
-		case <-d.ctx.Done():
-			for _, out := range outputs {
-				out.Stop()
+		case <-q.done:
+		case <-deadline:
+			for _, q := range queues {
+				select {
+				case <-q.done:
+				default:
+					log.Warn("output did not drain in time", "output", q.name, "timeout", drainTimeout)
+				}
 			}
 			return
-		case m := <-d.outCh:
-			for _, out := range outputs {
-				out.Send(m)
-			}
 		}
 	}
 }
 
+// Dropped returns, per output name, the number of metrics discarded
+// because that output's queue was full.
+func (d *Daemon) Dropped() map[string]uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := make(map[string]uint64, len(d.outputs))
+	for name, q := range d.outputs {
+		dropped[name] = q.Dropped()
+	}
+	return dropped
+}
+
+// Ready is closed once Run has started the configured outputs and probes.
+func (d *Daemon) Ready() <-chan struct{} {
+	return d.ready
+}
+
+// Stop cancels all probes and waits for Run to flush the outputs.
 func (d *Daemon) Stop() {
 	d.cancel()
+	<-d.done
 }
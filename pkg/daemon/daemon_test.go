@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/plugin"
+)
+
+// built counts the fake probes constructed, by name, and stopped records
+// the probe_stopped events the fake outputs were sent.
+var built = struct {
+	sync.Mutex
+	n       map[string]int
+	stopped []string
+}{n: make(map[string]int)}
+
+type fakeProbe struct{ cfg plugin.ProbeConfig }
+
+func (p *fakeProbe) Name() string            { return p.cfg.Name }
+func (p *fakeProbe) Interval() time.Duration { return p.cfg.Interval }
+func (p *fakeProbe) Run(ctx context.Context) []plugin.Metric {
+	return []plugin.Metric{plugin.NewMetric(p.cfg.Name, "fake")}
+}
+
+type fakeOutput struct{}
+
+func (fakeOutput) Name() string { return "fake" }
+func (fakeOutput) Start() error { return nil }
+func (fakeOutput) Stop() error  { return nil }
+func (fakeOutput) Send(m plugin.Metric) {
+	if m.Tags[plugin.TagEvent] == plugin.EventProbeStopped {
+		built.Lock()
+		built.stopped = append(built.stopped, m.Probe+" "+m.Text["reason"])
+		built.Unlock()
+	}
+}
+
+func init() {
+	plugin.RegisterProbe("fake", func(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+		built.Lock()
+		built.n[cfg.Name]++
+		built.Unlock()
+		return &fakeProbe{cfg}, nil
+	})
+	plugin.RegisterOutput("fake", func(plugin.OutputConfig) (plugin.Output, error) { return fakeOutput{}, nil })
+}
+
+func fakeConfig(targets ...string) *config.Config {
+	cfg := &config.Config{Outputs: []config.OutputConfig{{Name: "a", Type: "fake"}, {Name: "b", Type: "fake"}}}
+	for i, target := range targets {
+		cfg.Probes = append(cfg.Probes, config.ProbeConfig{
+			Name: string(rune('p' + i)), Type: "fake", Target: target, Interval: time.Hour,
+		})
+	}
+	return cfg
+}
+
+// running returns the daemon's probe and output instances by name.
+func running(d *Daemon) (map[string]*runningProbe, map[string]*outputQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	probes := make(map[string]*runningProbe, len(d.probes))
+	for name, rp := range d.probes {
+		probes[name] = rp
+	}
+	outputs := make(map[string]*outputQueue, len(d.outputs))
+	for name, q := range d.outputs {
+		outputs[name] = q
+	}
+	return probes, outputs
+}
+
+func TestReload(t *testing.T) {
+	built.Lock()
+	built.n = make(map[string]int)
+	built.stopped = nil
+	built.Unlock()
+	d, _ := New(fakeConfig("one", "two", "three", "four"))
+	ctx, cancel := context.WithCancel(context.Background())
+	go d.Run(ctx)
+	defer d.Stop()
+	defer cancel()
+	<-d.Ready()
+	probes, outputs := running(d)
+
+	cfg := fakeConfig("one", "changed", "three")
+	cfg.Outputs[1].QueueSize = 10
+	d.Reload(cfg)
+	newProbes, newOutputs := running(d)
+	for deadline := time.Now().Add(5 * time.Second); newProbes["q"] == probes["q"] || newOutputs["b"] == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("reload not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+		newProbes, newOutputs = running(d)
+	}
+
+	for _, name := range []string{"p", "r"} {
+		if newProbes[name] != probes[name] {
+			t.Errorf("unchanged probe %s was restarted", name)
+		}
+	}
+	if _, ok := newProbes["s"]; ok {
+		t.Error("removed probe s is still running")
+	}
+	if newProbes["q"].cfg.Target != "changed" {
+		t.Errorf("changed probe q runs target %q", newProbes["q"].cfg.Target)
+	}
+	if newOutputs["a"] != outputs["a"] {
+		t.Error("unchanged output a was restarted")
+	}
+	if newOutputs["b"] == outputs["b"] {
+		t.Error("changed output b was not restarted")
+	}
+	select {
+	case <-outputs["b"].done:
+	default:
+		t.Error("replaced output b was not stopped")
+	}
+
+	// each probe is only built once per config
+	built.Lock()
+	defer built.Unlock()
+	if built.n["p"] != 1 || built.n["q"] != 2 || built.n["r"] != 1 || built.n["s"] != 1 {
+		t.Errorf("probes built %v, want p:1 q:2 r:1 s:1", built.n)
+	}
+	// output a, and the new b, hear of q and s
+	for deadline := time.Now().Add(5 * time.Second); len(built.stopped) < 4 && time.Now().Before(deadline); {
+		built.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		built.Lock()
+	}
+	stopped := append([]string(nil), built.stopped...)
+	sort.Strings(stopped)
+	if want := []string{"q changed", "q changed", "s removed", "s removed"}; !reflect.DeepEqual(stopped, want) {
+		t.Errorf("probe_stopped events %q, want %q", stopped, want)
+	}
+}
@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds the number of probe runs in flight across all probes. Its
+// limit can change on reload while runs are waiting.
+type limiter struct {
+	mu      sync.Mutex
+	max     int // 0 for no limit
+	running int
+	changed chan struct{} // closed and replaced when a slot frees up
+}
+
+func newLimiter() *limiter {
+	return &limiter{changed: make(chan struct{})}
+}
+
+// acquire waits for a free slot. It returns false if ctx is done first.
+func (l *limiter) acquire(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		if l.max == 0 || l.running < l.max {
+			l.running++
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.running--
+	l.wake()
+	l.mu.Unlock()
+}
+
+func (l *limiter) setMax(max int) {
+	l.mu.Lock()
+	l.max = max
+	l.wake()
+	l.mu.Unlock()
+}
+
+// wake lets every waiting acquire check again. l.mu must be held.
+func (l *limiter) wake() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
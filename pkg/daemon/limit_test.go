@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// acquired reports whether acquire gets a slot within d.
+func acquired(l *limiter, d time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return l.acquire(ctx)
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter()
+	for i := 0; i < 5; i++ {
+		if !acquired(l, time.Second) {
+			t.Fatalf("unlimited acquire %d failed", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		l.release()
+	}
+
+	l.setMax(2)
+	if !acquired(l, time.Second) || !acquired(l, time.Second) {
+		t.Fatal("acquire below max failed")
+	}
+	if acquired(l, 50*time.Millisecond) {
+		t.Fatal("acquire above max succeeded")
+	}
+
+	got := make(chan bool)
+	go func() { got <- acquired(l, 5*time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	l.release()
+	if !<-got {
+		t.Fatal("waiting acquire did not get the released slot")
+	}
+}
+
+func TestLimiterSetMax(t *testing.T) {
+	l := newLimiter()
+	l.setMax(1)
+	if !acquired(l, time.Second) {
+		t.Fatal("first acquire failed")
+	}
+	got := make(chan bool)
+	go func() { got <- acquired(l, 5*time.Second) }()
+	time.Sleep(20 * time.Millisecond)
+	l.setMax(2)
+	if !<-got {
+		t.Fatal("waiting acquire did not get a slot when max was raised")
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := newLimiter()
+	l.setMax(1)
+	acquired(l, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan bool)
+	go func() { got <- l.acquire(ctx) }()
+	cancel()
+	select {
+	case ok := <-got:
+		if ok {
+			t.Error("acquire succeeded after ctx was cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire did not return when ctx was cancelled")
+	}
+}
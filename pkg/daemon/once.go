@@ -0,0 +1,40 @@
+package daemon
+
+import (
+	"context"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/plugin"
+)
+
+// RunOnce runs the probe configured by cfg a single time, with the same
+// deadline a scheduled run gets, and returns its metrics with the
+// configured tags added.
+func RunOnce(ctx context.Context, cfg config.ProbeConfig) ([]plugin.Metric, error) {
+	pr, err := plugin.NewProbe(cfg)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.RunTimeout
+	if timeout <= 0 {
+		timeout = cfg.Interval
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan []plugin.Metric, 1)
+	go func() { done <- pr.Run(runCtx) }()
+	var metrics []plugin.Metric
+	select {
+	case metrics = <-done:
+	case <-time.After(timeout + maxGrace):
+	}
+	if len(metrics) == 0 && runCtx.Err() == context.DeadlineExceeded {
+		metrics = []plugin.Metric{timeoutMetric(cfg, timeout)}
+	}
+	for i := range metrics {
+		addTags(&metrics[i], cfg.Tags)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/plugin"
+	"tokeping/plugins/exec"
+)
+
+func TestRunOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  []string
+		interval time.Duration
+		ok       bool
+		value    float64
+		failure  string
+	}{
+		{"ok", []string{"echo", "42"}, time.Minute, true, 42, ""},
+		{"failed", []string{"sh", "-c", "echo 1; exit 2"}, time.Minute, false, 1, plugin.FailureOther},
+		// the interval is the deadline of the run
+		{"deadline", []string{"sleep", "30"}, 200 * time.Millisecond, false, 0, plugin.FailureTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.ProbeConfig{
+				Name:     "once",
+				Type:     "exec",
+				Target:   "check",
+				Interval: tt.interval,
+				Command:  tt.command,
+				Tags:     map[string]string{"site": "lab"},
+			}
+			start := time.Now()
+			metrics, err := RunOnce(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if took := time.Since(start); took > tt.interval+maxGrace+time.Second {
+				t.Errorf("took %s", took)
+			}
+			if len(metrics) != 1 {
+				t.Fatalf("got %d metrics, want 1", len(metrics))
+			}
+			m := metrics[0]
+			if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+				t.Errorf("status %s (%s), want ok=%v", m.Status, m.Error, tt.ok)
+			}
+			if m.Probe != "once" || m.Fields[exec.FieldValue] != tt.value {
+				t.Errorf("probe %q, value %v, want once, %v", m.Probe, m.Fields[exec.FieldValue], tt.value)
+			}
+			if m.Tags[plugin.TagFailure] != tt.failure {
+				t.Errorf("failure %q, want %q", m.Tags[plugin.TagFailure], tt.failure)
+			}
+			if m.Tags["site"] != "lab" {
+				t.Errorf("configured tags not added: %v", m.Tags)
+			}
+		})
+	}
+
+	if _, err := RunOnce(context.Background(), config.ProbeConfig{Name: "x", Type: "pnig", Interval: time.Minute}); err == nil {
+		t.Error("ran a probe of an unknown type")
+	}
+}
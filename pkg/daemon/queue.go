@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/plugin"
+	"tokeping/pkg/stats"
+)
+
+// Overflow policies for a full output queue.
+const (
+	OverflowDropOldest = "drop-oldest"
+	OverflowDropNewest = "drop-newest"
+	OverflowBlock      = "block"
+)
+
+const defaultQueueSize = 1000
+
+// outputQueue feeds a single output from its own goroutine, so a slow or
+// stuck Send only backs up that output's queue instead of the daemon.
+type outputQueue struct {
+	name    string
+	cfg     config.OutputConfig
+	out     plugin.Output
+	policy  string
+	ch      chan plugin.Metric
+	stop    chan struct{}
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+func newOutputQueue(cfg config.OutputConfig, out plugin.Output) (*outputQueue, error) {
+	size, policy := cfg.QueueSize, cfg.Overflow
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	switch policy {
+	case "":
+		policy = OverflowDropOldest
+	case OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy %q", policy)
+	}
+	return &outputQueue{
+		name:   cfg.Name,
+		cfg:    cfg,
+		out:    out,
+		policy: policy,
+		ch:     make(chan plugin.Metric, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case m := <-q.ch:
+			q.out.Send(m)
+		case <-q.stop:
+			// deliver whatever is still queued, then shut the output down
+			for {
+				select {
+				case m := <-q.ch:
+					q.out.Send(m)
+				default:
+					if err := q.out.Stop(); err != nil {
+						log.Error("output failed to stop", "output", q.name, "err", err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// push enqueues m according to the overflow policy. It only blocks under
+// the "block" policy, and never after close.
+func (q *outputQueue) push(m plugin.Metric) {
+	select {
+	case q.ch <- m:
+		return
+	default:
+	}
+
+	switch q.policy {
+	case OverflowBlock:
+		select {
+		case q.ch <- m:
+		case <-q.stop:
+		}
+	case OverflowDropNewest:
+		q.drop()
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-q.ch:
+				q.drop()
+			default:
+			}
+			select {
+			case q.ch <- m:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (q *outputQueue) drop() {
+	n := q.dropped.Add(1)
+	stats.OutputDropped.Inc(q.name)
+	if n == 1 || n%1000 == 0 {
+		log.Warn("output queue full, dropping metrics", "output", q.name, "dropped", n)
+	}
+}
+
+// close stops accepting metrics and lets run drain the queue.
+func (q *outputQueue) close() {
+	close(q.stop)
+}
+
+// Dropped returns the number of metrics discarded because the queue was full.
+func (q *outputQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
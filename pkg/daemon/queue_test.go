@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/plugin"
+	"tokeping/pkg/stats"
+)
+
+// blockedOutput records the probes of the metrics it is sent. Send blocks
+// until release is closed, and reports on sending that it was entered.
+type blockedOutput struct {
+	mu      sync.Mutex
+	got     []string
+	sending chan struct{}
+	release chan struct{}
+}
+
+func newBlockedOutput() *blockedOutput {
+	return &blockedOutput{sending: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (o *blockedOutput) Name() string { return "blocked" }
+func (o *blockedOutput) Start() error { return nil }
+func (o *blockedOutput) Stop() error  { return nil }
+func (o *blockedOutput) Send(m plugin.Metric) {
+	o.sending <- struct{}{}
+	<-o.release
+	o.mu.Lock()
+	o.got = append(o.got, m.Probe)
+	o.mu.Unlock()
+}
+
+func TestQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    []string
+		dropped uint64
+	}{
+		{OverflowDropOldest, []string{"m1", "m3", "m4"}, 1},
+		{OverflowDropNewest, []string{"m1", "m2", "m3"}, 1},
+		{OverflowBlock, []string{"m1", "m2", "m3", "m4"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			name := "queue-" + tt.policy
+			before := stats.OutputDropped.Snapshot()[name]
+			out := newBlockedOutput()
+			q, err := newOutputQueue(config.OutputConfig{Name: name, QueueSize: 2, Overflow: tt.policy}, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go q.run()
+
+			// m1 is taken and stuck in Send, m2 and m3 fill the queue
+			q.push(plugin.NewMetric("m1", "test"))
+			<-out.sending
+			q.push(plugin.NewMetric("m2", "test"))
+			q.push(plugin.NewMetric("m3", "test"))
+
+			pushed := make(chan struct{})
+			go func() {
+				q.push(plugin.NewMetric("m4", "test"))
+				close(pushed)
+			}()
+			select {
+			case <-pushed:
+				if tt.policy == OverflowBlock {
+					t.Fatal("push into a full queue returned under the block policy")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if tt.policy != OverflowBlock {
+					t.Fatal("push into a full queue blocked")
+				}
+			}
+
+			close(out.release)
+			<-pushed
+			q.close()
+			<-q.done
+			if !reflect.DeepEqual(out.got, tt.want) {
+				t.Errorf("delivered %v, want %v", out.got, tt.want)
+			}
+			if got := q.Dropped(); got != tt.dropped {
+				t.Errorf("Dropped() = %d, want %d", got, tt.dropped)
+			}
+			if got := stats.OutputDropped.Snapshot()[name] - before; got != tt.dropped {
+				t.Errorf("stats.OutputDropped counted %d, want %d", got, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestQueueDropCount(t *testing.T) {
+	out := newBlockedOutput()
+	q, err := newOutputQueue(config.OutputConfig{Name: "count", QueueSize: 3}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is taken off the queue: all but the last 3 of 10 are dropped
+	for i := 0; i < 10; i++ {
+		q.push(plugin.NewMetric(fmt.Sprint("m", i), "test"))
+	}
+	if got := q.Dropped(); got != 7 {
+		t.Errorf("Dropped() = %d, want 7", got)
+	}
+	close(out.release)
+	go q.run()
+	q.close()
+	<-q.done
+	if want := []string{"m7", "m8", "m9"}; !reflect.DeepEqual(out.got, want) {
+		t.Errorf("delivered %v, want %v", out.got, want)
+	}
+}
+
+func TestQueuePolicy(t *testing.T) {
+	if _, err := newOutputQueue(config.OutputConfig{Name: "x", Overflow: "drop-all"}, newBlockedOutput()); err == nil {
+		t.Error("accepted an unknown overflow policy")
+	}
+	q, err := newOutputQueue(config.OutputConfig{Name: "x"}, newBlockedOutput())
+	if err != nil || q.policy != OverflowDropOldest || cap(q.ch) != defaultQueueSize {
+		t.Errorf("defaults: policy %q, size %d, %v", q.policy, cap(q.ch), err)
+	}
+}
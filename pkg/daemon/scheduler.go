@@ -0,0 +1,318 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+	"tokeping/pkg/stats"
+)
+
+// Longest a tick waits for a run that has reached its deadline to return
+// before the run is reported as timed out and the tick skipped.
+const maxGrace = time.Second
+
+// The first run of every probe comes within this long of the start, or of
+// one interval if that is shorter.
+const startupWindow = 10 * time.Second
+
+// schedule runs pr every interval until ctx is done, sending the metrics
+// to the daemon. Each run gets a deadline of run_timeout, the interval by
+// default. A run that does not return by then is reported as a timeout
+// failure; whatever it returns later is discarded. Ticks that come while
+// a run is still going are skipped, and runs that take noticeably longer
+// than the interval are counted as overruns.
+//
+// So that hundreds of probes don't all fire at once, each probe runs at
+// its own offset into the interval, derived from its name so it is the
+// same on every start, and each run can be delayed by a random jitter,
+// which comes out of its deadline. The first run comes right after the
+// start, at the same offset scaled down to the startup window. Runs wait
+// for a slot if max_concurrent runs are already in flight; a run that
+// timed out gives its slot up even if it has not returned.
+func (d *Daemon) schedule(ctx context.Context, cfg config.ProbeConfig, pr plugin.Probe) {
+	s := &scheduler{
+		cfg:      cfg,
+		probe:    pr,
+		interval: pr.Interval(),
+		timeout:  cfg.RunTimeout,
+		jitter:   cfg.Jitter,
+		limit:    d.limit,
+		out:      d.outCh,
+		log:      logging.New("scheduler").With("probe", cfg.Name).Debugging(cfg.Debug),
+		done:     make(chan []plugin.Metric, 1),
+	}
+	if s.timeout <= 0 {
+		s.timeout = s.interval
+	}
+	s.grace = s.interval / 10
+	if s.grace > maxGrace {
+		s.grace = maxGrace
+	}
+	s.loop(ctx, offset(cfg.Name, s.interval))
+}
+
+// offset returns where in the interval the probe called name runs.
+// Similar names such as web1 and web2 get unrelated offsets.
+func offset(name string, interval time.Duration) time.Duration {
+	sum := sha256.Sum256([]byte(name))
+	return time.Duration(binary.BigEndian.Uint64(sum[:8]) % uint64(interval))
+}
+
+type scheduler struct {
+	cfg      config.ProbeConfig
+	probe    plugin.Probe
+	interval time.Duration
+	timeout  time.Duration
+	grace    time.Duration
+	jitter   time.Duration
+	limit    *limiter
+	out      chan<- plugin.Metric
+	log      *logging.Logger
+
+	// state of the current run
+	running  bool
+	timedOut bool // reported as a timeout, its result is discarded
+	started  time.Time
+	until    time.Time        // the run's deadline
+	deadline <-chan time.Time // until plus the grace, nil once handled
+	runCtx   context.Context
+	release  func() // gives up the run's max_concurrent slot, once
+	done     chan []plugin.Metric
+}
+
+func (s *scheduler) loop(ctx context.Context, offset time.Duration) {
+	window := startupWindow
+	if window > s.interval {
+		window = s.interval
+	}
+	first := time.Duration(float64(offset) * float64(window) / float64(s.interval))
+	if !sleep(ctx, first) {
+		return
+	}
+	if !s.due(ctx, nil) {
+		return
+	}
+
+	// the regular runs start at the offset, unless that is too close to
+	// the first run
+	next := offset - first
+	if next < s.interval/2 {
+		next += s.interval
+	}
+	regular := time.After(next)
+	var ticker *time.Ticker
+	var ticks <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-regular:
+			regular = nil
+			ticker = time.NewTicker(s.interval)
+			ticks = ticker.C
+			if !s.due(ctx, ticker) {
+				return
+			}
+		case <-ticks:
+			if !s.due(ctx, ticker) {
+				return
+			}
+		case <-s.deadline:
+			s.deadline = nil
+			if s.running && !s.timedOut {
+				s.stuck(ctx)
+			}
+		case metrics := <-s.done:
+			s.finish(ctx, metrics)
+		}
+	}
+}
+
+// due starts a run, or skips it if the previous one is still going. It
+// returns false if ctx is done. ticker is nil before the regular runs.
+func (s *scheduler) due(ctx context.Context, ticker *time.Ticker) bool {
+	if s.running && !s.timedOut && time.Until(s.until) < s.grace {
+		// a run at its deadline gets a moment to return
+		select {
+		case metrics := <-s.done:
+			s.finish(ctx, metrics)
+		case <-time.After(s.grace):
+			s.stuck(ctx)
+		}
+	}
+	if s.running {
+		s.skip()
+		return true
+	}
+	if !s.start(ctx) {
+		return false
+	}
+	// a tick that passed while waiting for a slot is skipped
+	if ticker != nil {
+		select {
+		case <-ticker.C:
+			s.skip()
+		default:
+		}
+	}
+	return true
+}
+
+func (s *scheduler) skip() {
+	stats.ProbeSkipped.Inc(s.cfg.Name)
+	if s.running {
+		s.log.Warn("skipped a run, the previous one is still going",
+			"running_for", time.Since(s.started).Round(time.Millisecond))
+	} else {
+		s.log.Warn("skipped a run waiting for one of max_concurrent slots")
+	}
+}
+
+// start waits out the jitter and for a free slot, then runs the probe once
+// in its own goroutine. The jitter is taken off the run's deadline, so a
+// delayed run still ends in time for the next tick. It returns false if
+// ctx is done first.
+func (s *scheduler) start(ctx context.Context) bool {
+	var jitter time.Duration
+	if s.jitter > 0 {
+		jitter = time.Duration(rand.Int63n(int64(s.jitter)))
+		if !sleep(ctx, jitter) {
+			return false
+		}
+	}
+	if !s.limit.acquire(ctx) {
+		return false
+	}
+	until := time.Now().Add(s.timeout - jitter)
+	runCtx, cancel := context.WithDeadline(ctx, until)
+	var once sync.Once
+	release := func() { once.Do(s.limit.release) }
+	s.running, s.timedOut = true, false
+	s.started, s.until = time.Now(), until
+	s.deadline = time.After(time.Until(until) + s.grace)
+	s.runCtx = runCtx
+	s.release = release
+	s.log.Debug("run started", "deadline", time.Until(until).Round(time.Millisecond))
+	done := s.done
+	go func() {
+		defer release()
+		defer cancel()
+		done <- s.probe.Run(runCtx)
+	}()
+	return true
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// finish handles the result of the current run.
+func (s *scheduler) finish(ctx context.Context, metrics []plugin.Metric) {
+	s.running = false
+	s.deadline = nil
+	// runs stopped at a deadline of one interval take a little longer
+	elapsed := time.Since(s.started)
+	if elapsed > s.interval+s.grace {
+		stats.ProbeOverruns.Inc(s.cfg.Name)
+		s.log.Warn("run overran the interval", "interval", s.interval, "took", elapsed.Round(time.Millisecond))
+	}
+	s.log.Debug("run finished", "took", elapsed.Round(time.Millisecond), "metrics", len(metrics))
+	if s.timedOut {
+		return // already reported
+	}
+	if s.runCtx.Err() == context.DeadlineExceeded {
+		// returned in time, normally with its own timeout failure
+		stats.ProbeTimeouts.Inc(s.cfg.Name)
+		if len(metrics) == 0 {
+			metrics = []plugin.Metric{s.timeoutMetric()}
+		}
+	}
+	for _, m := range metrics {
+		if s.log.Enabled(logging.LevelDebug) {
+			kv := []interface{}{"status", m.Status, "fields", fields(m.Fields)}
+			if m.Error != "" {
+				kv = append(kv, "error", m.Error)
+			}
+			s.log.Debug("metric", kv...)
+		}
+		s.send(ctx, m)
+	}
+}
+
+// fields renders metric fields as sorted name=value pairs for the log.
+func fields(f map[string]float64) string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%g", name, f[name])
+	}
+	return b.String()
+}
+
+// stuck reports the current run as timed out because it did not return by
+// its deadline, and frees its slot for other probes. Its result is
+// discarded when it does return, and until then the probe's ticks are
+// skipped, so a probe never has more than one stuck run.
+func (s *scheduler) stuck(ctx context.Context) {
+	s.timedOut = true
+	s.release()
+	stats.ProbeTimeouts.Inc(s.cfg.Name)
+	s.log.Warn("run did not finish in time, releasing its slot", "run_timeout", s.timeout)
+	s.send(ctx, s.timeoutMetric())
+}
+
+func (s *scheduler) timeoutMetric() plugin.Metric {
+	return timeoutMetric(s.cfg, s.timeout)
+}
+
+// timeoutMetric is the failure reported for a run of the probe configured
+// by cfg that did not finish within timeout.
+func timeoutMetric(cfg config.ProbeConfig, timeout time.Duration) plugin.Metric {
+	m := plugin.NewMetric(cfg.Name, cfg.Type)
+	m.Tags[plugin.TagTarget] = cfg.Target
+	m.Tags[plugin.TagFailure] = plugin.FailureTimeout
+	m.Fail(fmt.Errorf("run did not finish within %s", timeout))
+	return m
+}
+
+func (s *scheduler) send(ctx context.Context, m plugin.Metric) {
+	if ctx.Err() != nil {
+		// stopped, possibly replaced by a reload
+		return
+	}
+	select {
+	case s.out <- m:
+	case <-ctx.Done():
+	}
+}
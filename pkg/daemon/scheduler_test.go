@@ -0,0 +1,104 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"tokeping/pkg/config"
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+)
+
+func TestOffset(t *testing.T) {
+	const interval = time.Minute
+	seen := make(map[time.Duration]string)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("web%d", i)
+		got := offset(name, interval)
+		if got < 0 || got >= interval {
+			t.Errorf("offset(%q) = %s, want within [0, %s)", name, got, interval)
+		}
+		if again := offset(name, interval); again != got {
+			t.Errorf("offset(%q) = %s, then %s", name, got, again)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("offset(%q) = offset(%q) = %s", name, other, got)
+		}
+		seen[got] = name
+	}
+	if a, b := offset("web1", interval), offset("web2", interval); b-a < time.Second && a-b < time.Second {
+		t.Errorf("similar names got close offsets %s and %s", a, b)
+	}
+}
+
+// hung is a probe whose runs ignore their deadline until it is closed.
+type hung chan struct{}
+
+func (hung) Name() string            { return "hung" }
+func (hung) Interval() time.Duration { return time.Minute }
+func (h hung) Run(context.Context) []plugin.Metric {
+	<-h
+	return nil
+}
+
+func newTestScheduler(pr plugin.Probe, limit *limiter, timeout, jitter time.Duration) *scheduler {
+	return &scheduler{
+		cfg:      config.ProbeConfig{Name: "test", Type: "test"},
+		probe:    pr,
+		interval: pr.Interval(),
+		timeout:  timeout,
+		grace:    10 * time.Millisecond,
+		jitter:   jitter,
+		limit:    limit,
+		out:      make(chan plugin.Metric, 10),
+		log:      logging.New("scheduler"),
+		done:     make(chan []plugin.Metric, 1),
+	}
+}
+
+func TestStuckReleasesSlot(t *testing.T) {
+	pr := make(hung)
+	defer close(pr)
+	limit := newLimiter()
+	limit.setMax(1)
+	s := newTestScheduler(pr, limit, 20*time.Millisecond, 0)
+	ctx := context.Background()
+	if !s.start(ctx) {
+		t.Fatal("start failed")
+	}
+	if acquired(limit, 10*time.Millisecond) {
+		t.Fatal("slot free while the run is going")
+	}
+	<-s.deadline
+	s.stuck(ctx)
+	if !acquired(limit, time.Second) {
+		t.Fatal("stuck run kept its slot")
+	}
+	limit.release()
+
+	// the run returning later must not free a second slot
+	pr <- struct{}{}
+	s.finish(ctx, <-s.done)
+	if !acquired(limit, time.Second) {
+		t.Fatal("first acquire after finish failed")
+	}
+	if acquired(limit, 10*time.Millisecond) {
+		t.Fatal("the slot was released twice")
+	}
+}
+
+func TestJitterDeadline(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	before := time.Now()
+	pr := make(hung)
+	defer close(pr)
+	s := newTestScheduler(pr, newLimiter(), timeout, 80*time.Millisecond)
+	if !s.start(context.Background()) {
+		t.Fatal("start failed")
+	}
+	if deadline, _ := s.runCtx.Deadline(); deadline.After(before.Add(timeout + 10*time.Millisecond)) {
+		t.Errorf("run deadline %s after the start, want at most %s", deadline.Sub(before), timeout)
+	}
+}
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+type formatter func(r *record) string
+
+func parseFormat(s string) (formatter, error) {
+	switch s {
+	case "", "logfmt":
+		return formatLogfmt, nil
+	case "json":
+		return formatJSON, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", s)
+}
+
+// pairs calls f for each key/value pair of r after the time, with values
+// turned into strings or numbers. A key without a value gets "!MISSING".
+func pairs(r *record, f func(key string, value interface{})) {
+	f("level", r.level.String())
+	if r.component != "" {
+		f("component", r.component)
+	}
+	f("msg", r.msg)
+	for i := 0; i < len(r.kv); i += 2 {
+		key := fmt.Sprint(r.kv[i])
+		if i+1 == len(r.kv) {
+			f(key, "!MISSING")
+			break
+		}
+		f(key, value(r.kv[i+1]))
+	}
+}
+
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(timeFormat)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// formatLogfmt renders r as a logfmt line, without the trailing newline:
+//
+//	time=2024-05-01T12:00:00.000+02:00 level=warn component=dns msg="query failed" probe=cf1
+func formatLogfmt(r *record) string {
+	var b strings.Builder
+	b.WriteString("time=")
+	b.WriteString(r.time.Format(timeFormat))
+	pairs(r, func(key string, v interface{}) {
+		b.WriteByte(' ')
+		b.WriteString(logfmtKey(key))
+		b.WriteByte('=')
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		b.WriteString(logfmtValue(s))
+	})
+	return b.String()
+}
+
+func logfmtKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// formatJSON renders r as one JSON object, keys in the order they were
+// given, without the trailing newline.
+func formatJSON(r *record) string {
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	b.WriteString(strconv.Quote(r.time.Format(timeFormat)))
+	pairs(r, func(key string, v interface{}) {
+		b.WriteByte(',')
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		j, err := json.Marshal(v)
+		if err != nil {
+			// NaN and Inf floats
+			j, _ = json.Marshal(fmt.Sprint(v))
+		}
+		b.Write(j)
+	})
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestFormatLogfmt(t *testing.T) {
+	tests := []struct {
+		name string
+		r    record
+		want string
+	}{
+		{
+			name: "plain",
+			r:    record{level: LevelWarn, component: "dns", msg: "query failed", kv: []interface{}{"probe", "cf1", "rtt", 12.5}},
+			want: `time=2024-05-01T12:00:00.000Z level=warn component=dns msg="query failed" probe=cf1 rtt=12.5`,
+		},
+		{
+			name: "no component",
+			r:    record{level: LevelInfo, msg: "started"},
+			want: `time=2024-05-01T12:00:00.000Z level=info msg=started`,
+		},
+		{
+			name: "quoting",
+			r: record{level: LevelDebug, msg: "m", kv: []interface{}{
+				"empty", "", "space", "a b", "eq", "a=b", "quote", `a"b`, "newline", "a\nb", "bad key", 1,
+			}},
+			want: `time=2024-05-01T12:00:00.000Z level=debug msg=m empty="" space="a b" eq="a=b" quote="a\"b" newline="a\nb" bad_key=1`,
+		},
+		{
+			name: "values",
+			r: record{level: LevelError, msg: "m", kv: []interface{}{
+				"err", errors.New("refused"), "took", 1500 * time.Millisecond, "nil", nil, "ok", true,
+			}},
+			want: `time=2024-05-01T12:00:00.000Z level=error msg=m err=refused took=1.5s nil="" ok=true`,
+		},
+		{
+			name: "missing value",
+			r:    record{level: LevelInfo, msg: "m", kv: []interface{}{"probe"}},
+			want: `time=2024-05-01T12:00:00.000Z level=info msg=m probe=!MISSING`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.r.time = testTime
+			if got := formatLogfmt(&tt.r); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		kv   []interface{}
+		want string
+	}{
+		{
+			name: "ordered",
+			kv:   []interface{}{"probe", "cf1", "rtt", 12.5, "sent", 20, "err", errors.New(`bad "reply"`)},
+			want: `"probe":"cf1","rtt":12.5,"sent":20,"err":"bad \"reply\""`,
+		},
+		{
+			name: "not a number",
+			kv:   []interface{}{"loss", math.NaN(), "max", math.Inf(1)},
+			want: `"loss":"NaN","max":"+Inf"`,
+		},
+		{
+			name: "missing value",
+			kv:   []interface{}{"probe"},
+			want: `"probe":"!MISSING"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := record{time: testTime, level: LevelWarn, component: "dns", msg: "query failed", kv: tt.kv}
+			want := `{"time":"2024-05-01T12:00:00.000Z","level":"warn","component":"dns","msg":"query failed",` + tt.want + "}"
+			if got := formatJSON(&r); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestJournalKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"probe":        "PROBE",
+		"run_timeout":  "RUN_TIMEOUT",
+		"http-version": "HTTP_VERSION",
+		"hop2":         "HOP2",
+		"rtt.ms":       "RTT_MS",
+	} {
+		if got := journalKey(key); got != want {
+			t.Errorf("journalKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestJournalSink(t *testing.T) {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "socket"), Net: "unixgram"}
+	journal, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer journal.Close()
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &journalSink{conn: conn}
+	defer s.close()
+
+	r := record{time: testTime, level: LevelWarn, component: "dns", msg: "query failed",
+		kv: []interface{}{"probe", "cf1", "err", "line one\nline two"}}
+	if err := s.write(&r); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	journalField(&want, "TOKEPING_COMPONENT", "dns")
+	journalField(&want, "TOKEPING_PROBE", "cf1")
+	journalField(&want, "TOKEPING_ERR", "line one\nline two")
+	journalField(&want, "MESSAGE", `query failed probe=cf1 err="line one\nline two"`)
+	journalField(&want, "PRIORITY", "4")
+	journalField(&want, "SYSLOG_IDENTIFIER", ident)
+	if got := buf[:n]; !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("got\n%q\nwant\n%q", got, want.Bytes())
+	}
+	// a multi-line value is sent as key, newline, little-endian length, value
+	if !bytes.Contains(buf[:n], []byte("TOKEPING_ERR\n\x11\x00\x00\x00\x00\x00\x00\x00line one\nline two\n")) {
+		t.Errorf("multi-line value not length-prefixed in %q", buf[:n])
+	}
+}
+
+func TestDebugging(t *testing.T) {
+	var b bytes.Buffer
+	mu.Lock()
+	oldLevel, oldOutput := level, output
+	level, output = LevelInfo, &writerSink{w: &b, format: formatLogfmt}
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		level, output = oldLevel, oldOutput
+		mu.Unlock()
+	}()
+
+	log := New("ping").With("probe", "a")
+	log.Debug("hidden")
+	log.Debugging(true).Debug("shown", "sent", 20)
+	log.Info("info")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), b.String())
+	}
+	if !strings.HasSuffix(lines[0], "level=debug component=ping msg=shown probe=a sent=20") {
+		t.Errorf("got %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "level=info component=ping msg=info probe=a") {
+		t.Errorf("got %s", lines[1])
+	}
+}
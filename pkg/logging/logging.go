@@ -0,0 +1,180 @@
+// Package logging writes the daemon's diagnostics as levelled, structured
+// records. Every part of tokeping logs through its own Logger, named after
+// the component (daemon, scheduler, dns, influxdb, ...), and adds key/value
+// pairs instead of formatting them into the message:
+//
+//	log := logging.New("dns").With("probe", cfg.Name)
+//	log.Warn("query failed", "server", server, "err", err)
+//
+// Where the records go and how they look is set for the whole process by
+// Setup, from the log section of the config file.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"tokeping/pkg/config"
+)
+
+// Level is the severity of a record.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called s, info for "".
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// record is a single log entry as handed to a sink.
+type record struct {
+	time      time.Time
+	level     Level
+	component string
+	msg       string
+	kv        []interface{} // alternating keys and values
+}
+
+// sink writes records somewhere.
+type sink interface {
+	write(r *record) error
+	close() error
+}
+
+var (
+	mu     sync.Mutex
+	level       = LevelInfo
+	output sink = &writerSink{w: os.Stderr, format: formatLogfmt}
+)
+
+// Setup switches all loggers to the level, format and output in cfg. The
+// previous output is closed, so calling Setup again on reload also reopens
+// a log file moved away by logrotate. On error the current setup is kept.
+func Setup(cfg config.LogConfig) error {
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	format, err := parseFormat(cfg.Format)
+	if err != nil {
+		return err
+	}
+	var s sink
+	switch cfg.Output {
+	case "", "stderr":
+		s = &writerSink{w: os.Stderr, format: format}
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("log file: %w", err)
+		}
+		s = &writerSink{w: f, format: format, closer: f}
+	case "syslog":
+		if s, err = newSyslog(format); err != nil {
+			return fmt.Errorf("syslog: %w", err)
+		}
+	case "journald":
+		if s, err = newJournal(); err != nil {
+			return fmt.Errorf("journald: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown log output %q", cfg.Output)
+	}
+
+	mu.Lock()
+	old := output
+	level, output = lvl, s
+	mu.Unlock()
+	return old.close()
+}
+
+// Logger logs the records of one component, with the pairs added by With
+// attached to each of them. A Logger is safe for concurrent use.
+type Logger struct {
+	component string
+	kv        []interface{}
+	debug     bool
+}
+
+// New returns the logger of component.
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger that adds the key/value pairs kv to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	c := *l
+	c.kv = append(append([]interface{}(nil), l.kv...), kv...)
+	return &c
+}
+
+// Debugging returns a logger that writes debug records when on, whatever
+// the configured level. It is how debug is enabled for a single probe.
+func (l *Logger) Debugging(on bool) *Logger {
+	c := *l
+	c.debug = on
+	return &c
+}
+
+// Enabled reports whether records at lvl are written, so that expensive
+// debug output can be skipped.
+func (l *Logger) Enabled(lvl Level) bool {
+	if lvl == LevelDebug && l.debug {
+		return true
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return lvl >= level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(lvl Level, msg string, kv []interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+	r := &record{
+		time:      time.Now(),
+		level:     lvl,
+		component: l.component,
+		msg:       msg,
+		kv:        append(append([]interface{}(nil), l.kv...), kv...),
+	}
+	mu.Lock()
+	err := output.write(r)
+	mu.Unlock()
+	if err != nil {
+		// last resort, so the record isn't lost without a trace
+		fmt.Fprintf(os.Stderr, "%s (log output failed: %v)\n", formatLogfmt(r), err)
+	}
+}
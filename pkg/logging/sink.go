@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+// Name the records are logged under in syslog and the journal.
+const ident = "tokeping"
+
+// writerSink writes one formatted line per record, to stderr or a file.
+type writerSink struct {
+	w      io.Writer
+	format formatter
+	closer io.Closer // nil for stderr, which stays open
+}
+
+func (s *writerSink) write(r *record) error {
+	_, err := io.WriteString(s.w, s.format(r)+"\n")
+	return err
+}
+
+func (s *writerSink) close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// syslogSink sends records to the local syslog daemon, at the priority of
+// their level. Syslog adds its own timestamp.
+type syslogSink struct {
+	w      *syslog.Writer
+	format formatter
+}
+
+func newSyslog(format formatter) (sink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, ident)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w, format: format}, nil
+}
+
+func (s *syslogSink) write(r *record) error {
+	line := s.format(r)
+	// drop the time, the first pair in both formats
+	if i := strings.Index(line, " level="); i >= 0 {
+		line = line[i+1:]
+	} else if i := strings.Index(line, `,"level":`); i >= 0 {
+		line = "{" + line[i+1:]
+	}
+	switch r.level {
+	case LevelDebug:
+		return s.w.Debug(line)
+	case LevelInfo:
+		return s.w.Info(line)
+	case LevelWarn:
+		return s.w.Warning(line)
+	}
+	return s.w.Err(line)
+}
+
+func (s *syslogSink) close() error {
+	return s.w.Close()
+}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalSink sends records to systemd-journald using its native protocol,
+// so that every key/value pair becomes a journal field that journalctl can
+// filter on, such as TOKEPING_PROBE=cf1.
+type journalSink struct {
+	conn *net.UnixConn
+}
+
+func newJournal() (sink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn}, nil
+}
+
+var journalPriority = map[Level]int{LevelDebug: 7, LevelInfo: 6, LevelWarn: 4, LevelError: 3}
+
+func (s *journalSink) write(r *record) error {
+	var b bytes.Buffer
+	var msg strings.Builder
+	msg.WriteString(r.msg)
+	pairs(r, func(key string, v interface{}) {
+		switch key {
+		case "level", "msg":
+			return
+		case "component":
+			journalField(&b, "TOKEPING_COMPONENT", fmt.Sprint(v))
+			return
+		}
+		// in the message too, for a plain journalctl
+		s := fmt.Sprint(v)
+		fmt.Fprintf(&msg, " %s=%s", logfmtKey(key), logfmtValue(s))
+		journalField(&b, "TOKEPING_"+journalKey(key), s)
+	})
+	journalField(&b, "MESSAGE", msg.String())
+	journalField(&b, "PRIORITY", fmt.Sprint(journalPriority[r.level]))
+	journalField(&b, "SYSLOG_IDENTIFIER", ident)
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+func (s *journalSink) close() error {
+	return s.conn.Close()
+}
+
+// journalField appends a field in the journal's native format. Values with
+// a newline are sent length-prefixed.
+func journalField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalKey turns key into a valid journal field name: upper case
+// letters, digits and underscores.
+func journalKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
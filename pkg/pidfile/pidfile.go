@@ -0,0 +1,168 @@
+// Package pidfile records the PID of a running tokeping daemon, so that
+// the stop, status and reload commands can find it and a second daemon
+// using the same config refuses to start.
+//
+// The daemon holds an exclusive lock on its PID file for as long as it
+// runs. The kernel drops the lock when the process exits, however it
+// exits, so a PID file that nobody has locked is stale, whatever process
+// its PID may belong to by now.
+package pidfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the PID file written by this process, locked until Remove
+var held *os.File
+
+// Read returns the PID stored in the file at path.
+func Read(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s: %q", path, bytes.TrimSpace(b))
+	}
+	return pid, nil
+}
+
+// Check returns the PID stored at path and whether the daemon that wrote
+// it is still running. A PID file left behind by a daemon that died is
+// stale: it reports false. A missing file is an error matching
+// os.ErrNotExist.
+func Check(path string) (pid int, running bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("read pid file: %w", err)
+	}
+	defer f.Close()
+	if pid, err = Read(path); err != nil {
+		return 0, false, err
+	}
+	locked, err := lock(f, syscall.LOCK_SH)
+	if err != nil {
+		return 0, false, err
+	}
+	return pid, !locked, nil
+}
+
+// Write records the current process at path and locks the file until
+// Remove. It fails if the file belongs to another tokeping that is still
+// running, and replaces a stale file.
+func Write(path string) error {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("write pid file: %w", err)
+		}
+		locked, err := lock(f, syscall.LOCK_EX)
+		if err != nil || !locked {
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if pid, err := Read(path); err == nil {
+				return fmt.Errorf("tokeping is already running, PID %d (from %s)", pid, path)
+			}
+			return fmt.Errorf("tokeping is already running (pid file %s is locked)", path)
+		}
+		if !current(f, path) {
+			// removed as stale while we waited for the lock
+			f.Close()
+			continue
+		}
+		if err := f.Truncate(0); err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+		}
+		if err != nil {
+			os.Remove(path)
+			f.Close()
+			return fmt.Errorf("write pid file: %w", err)
+		}
+		held = f
+		return nil
+	}
+}
+
+// Remove deletes the PID file at path if this process wrote it, so a
+// daemon shutting down never removes the file of another, and drops the
+// lock.
+func Remove(path string) error {
+	if held == nil {
+		return nil
+	}
+	defer func() {
+		held.Close()
+		held = nil
+	}()
+	if !current(held, path) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// RemoveStale deletes the PID file at path if no running daemon holds it.
+// It returns an error if one does.
+func RemoveStale(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("remove stale pid file: %w", err)
+	}
+	defer f.Close()
+	locked, err := lock(f, syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("pid file %s is not stale, tokeping is running", path)
+	}
+	if !current(f, path) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove stale pid file: %w", err)
+	}
+	return nil
+}
+
+// lock takes a lock of the kind how on f without waiting for a running
+// daemon, and reports whether it got it. A lock held only for a moment,
+// by another command checking the file, is waited out.
+func lock(f *os.File, how int) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, fmt.Errorf("lock pid file: %w", err)
+		}
+		if attempt == 4 {
+			return false, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// current reports whether f is still the file at path, and not one that
+// has been removed or replaced since it was opened.
+func current(f *os.File, path string) bool {
+	opened, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	now, err := os.Stat(path)
+	return err == nil && os.SameFile(opened, now)
+}
@@ -0,0 +1,94 @@
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokeping.pid")
+	if err := Write(path); err != nil {
+		t.Fatal(err)
+	}
+	pid, running, err := Check(path)
+	if err != nil || pid != os.Getpid() || !running {
+		t.Errorf("Check = %d, %v, %v, want %d, true, nil", pid, running, err, os.Getpid())
+	}
+
+	// flock locks belong to the open file, so a second Write in the
+	// same process is refused like another daemon would be
+	if err := Write(path); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("second Write = %v, want already running", err)
+	}
+	if err := RemoveStale(path); err == nil {
+		t.Error("RemoveStale removed the file of a running daemon")
+	}
+
+	if err := Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Check(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Check after Remove = %v, want not exist", err)
+	}
+}
+
+func TestStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokeping.pid")
+	// an unlocked file is stale even though it names a live process
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getppid())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pid, running, err := Check(path)
+	if err != nil || pid != os.Getppid() || running {
+		t.Errorf("Check = %d, %v, %v, want %d, false, nil", pid, running, err, os.Getppid())
+	}
+
+	if err := Write(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := Read(path); err != nil || pid != os.Getpid() {
+		t.Errorf("Read after replacing a stale file = %d, %v, want %d", pid, err, os.Getpid())
+	}
+	Remove(path)
+
+	os.WriteFile(path, []byte("123\n"), 0644)
+	if err := RemoveStale(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stale file still there: %v", err)
+	}
+	if err := RemoveStale(path); err != nil {
+		t.Errorf("RemoveStale of a missing file = %v", err)
+	}
+}
+
+func TestRemoveReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokeping.pid")
+	if err := Write(path); err != nil {
+		t.Fatal(err)
+	}
+	// someone else's file now, which Remove must leave alone
+	os.Remove(path)
+	os.WriteFile(path, []byte("123\n"), 0644)
+	if err := Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := Read(path); err != nil || pid != 123 {
+		t.Errorf("Read = %d, %v, want the other file kept", pid, err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokeping.pid")
+	for _, content := range []string{"", "abc\n", "-1\n", "0"} {
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := Read(path); err == nil {
+			t.Errorf("Read(%q) succeeded", content)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	goplugin "plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"tokeping/pkg/logging"
+)
+
+// APIVersion is the version of the Probe, Output and Metric API seen by
+// plugins. It goes up with every change that breaks plugins built against
+// the previous version, and plugins built for another version are refused.
+const APIVersion = 2
+
+// VersionSymbol is the variable every plugin .so exports to declare the
+// APIVersion it was built for:
+//
+//	var TokepingAPIVersion = plugin.APIVersion
+const VersionSymbol = "TokepingAPIVersion"
+
+var (
+	loadMu sync.Mutex
+	loaded = make(map[string]error) // by absolute path, with the load result of opened plugins
+
+	// registrations made while a plugin is being loaded, committed only
+	// if the plugin turns out to be compatible
+	staged *registrations
+)
+
+type registrations struct {
+	probes           map[string]func(ProbeConfig) (Probe, error)
+	outputs          map[string]func(OutputConfig) (Output, error)
+	probeValidators  map[string]func(ProbeConfig) error
+	outputValidators map[string]func(OutputConfig) error
+}
+
+// LoadDir loads every .so file in dir, in name order. Go cannot unload or
+// reload a plugin, so one that was opened before is not opened again; it
+// keeps the result of its first load. A file that could not be opened at
+// all is tried again on the next load, so it can be fixed without a restart.
+func LoadDir(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("plugin directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	var errs []error
+	for _, path := range paths {
+		if err := Load(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Load opens the Go plugin at path. Its init functions register probe and
+// output types with RegisterProbe and RegisterOutput as the built-in
+// plugins do; the types only become available if the plugin exports a
+// VersionSymbol matching APIVersion and does not redefine an existing type.
+func Load(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	if err, ok := loaded[abs]; ok {
+		return err
+	}
+	opened, err := load(path, abs)
+	if opened {
+		loaded[abs] = err
+	}
+	return err
+}
+
+// load opens and checks the plugin at path, reporting whether it was
+// opened: from then on it is part of the process, compatible or not.
+func load(path, abs string) (bool, error) {
+	staged = &registrations{
+		probes:           make(map[string]func(ProbeConfig) (Probe, error)),
+		outputs:          make(map[string]func(OutputConfig) (Output, error)),
+		probeValidators:  make(map[string]func(ProbeConfig) error),
+		outputValidators: make(map[string]func(OutputConfig) error),
+	}
+	r := staged
+	p, err := goplugin.Open(abs)
+	staged = nil
+	if err != nil {
+		return false, fmt.Errorf("plugin %s: %v", path, err)
+	}
+
+	sym, err := p.Lookup(VersionSymbol)
+	if err != nil {
+		return true, fmt.Errorf("plugin %s: not a tokeping plugin, %s is missing", path, VersionSymbol)
+	}
+	version, ok := sym.(*int)
+	if !ok {
+		return true, fmt.Errorf("plugin %s: %s must be an int", path, VersionSymbol)
+	}
+	if *version != APIVersion {
+		return true, fmt.Errorf("plugin %s: built for plugin API version %d, this tokeping has version %d", path, *version, APIVersion)
+	}
+	if len(r.probes) == 0 && len(r.outputs) == 0 {
+		return true, fmt.Errorf("plugin %s: registers no probe or output types", path)
+	}
+	for typ := range r.probes {
+		if _, ok := probeFactories[typ]; ok {
+			return true, fmt.Errorf("plugin %s: probe type %q is already registered", path, typ)
+		}
+	}
+	for typ := range r.outputs {
+		if _, ok := outputFactories[typ]; ok {
+			return true, fmt.Errorf("plugin %s: output type %q is already registered", path, typ)
+		}
+	}
+
+	for typ, f := range r.probes {
+		probeFactories[typ] = f
+	}
+	for typ, f := range r.outputs {
+		outputFactories[typ] = f
+	}
+	for typ, v := range r.probeValidators {
+		probeValidators[typ] = v
+	}
+	for typ, v := range r.outputValidators {
+		outputValidators[typ] = v
+	}
+	logging.New("plugin").Info("loaded plugin", "path", path, "probes", types(r.probes), "outputs", types(r.outputs))
+	return true, nil
+}
+
+func types[T any](m map[string]T) string {
+	if len(m) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(m))
+	for typ := range m {
+		names = append(names, typ)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
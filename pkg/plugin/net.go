@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// PreferIPv6 picks the address family used to reach target. family is
+// "ipv6", "ipv4" or empty for the IPv6-first default: IPv6 unless target
+// is a legacy IP literal or only resolves to legacy IP addresses.
+func PreferIPv6(target, family string) (bool, error) {
+	switch family {
+	case "ipv6":
+		return true, nil
+	case "ipv4":
+		return false, nil
+	case "":
+	default:
+		return false, fmt.Errorf("unknown address family %q (want ipv6 or ipv4)", family)
+	}
+
+	// Check if target is a literal IP
+	if ip := net.ParseIP(target); ip != nil {
+		return ip.To4() == nil, nil
+	}
+	// Domain name: lookup addresses
+	addrs, err := net.LookupIP(target)
+	if err != nil {
+		return true, nil
+	}
+	for _, addr := range addrs {
+		if addr.To4() == nil {
+			return true, nil
+		}
+	}
+	return len(addrs) == 0, nil
+}
+
+// ResolveIP returns the first address of host in the requested family.
+func ResolveIP(ctx context.Context, host string, ipv6 bool) (net.IP, error) {
+	network := "ip4"
+	if ipv6 {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// Failure kinds for the TagFailure tag on failed metrics.
+const (
+	TagFailure = "failure"
+
+	FailureTimeout     = "timeout"
+	FailureRefused     = "refused"
+	FailureUnreachable = "unreachable"
+	FailureResolve     = "resolve"
+	FailureReset       = "reset"
+	FailureUnexpected  = "unexpected" // answered, but not as expected
+	FailureOther       = "error"
+)
+
+// ClassifyError maps a network error to one of the Failure kinds.
+func ClassifyError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return FailureResolve
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return FailureTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return FailureRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return FailureReset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return FailureUnreachable
+	}
+	return FailureOther
+}
@@ -3,16 +3,104 @@ package plugin
 import (
     "context"
     "time"
+
+    "tokeping/pkg/logging"
+)
+
+// Status reports whether a probe run produced a valid measurement.
+type Status string
+
+const (
+    StatusOK    Status = "ok"
+    StatusError Status = "error"
+)
+
+// Well-known field names. Latencies are in milliseconds.
+const (
+    FieldRTT    = "rtt"
+    FieldLoss   = "loss" // percent
+    FieldJitter = "jitter"
+    FieldRcode  = "rcode"
+    FieldHop    = "hop"
+)
+
+// Well-known tag names.
+const (
+    TagTarget   = "target"
+    TagFamily   = "family" // "ipv6" or "ipv4"
+    TagResolver = "resolver"
+    TagProtocol = "protocol"
+    TagHop      = "hop"
+    TagAddr     = "addr"
+    TagEvent    = "event" // set on events, which are not measurements
+)
+
+// Event kinds for the TagEvent tag.
+const (
+    EventPathChange = "path_change"
+    // sent by the daemon when a reload stops a probe, so outputs can
+    // forget its series
+    EventProbeStopped = "probe_stopped"
 )
 
 type Metric struct {
-    Probe   string
-    Time    int64
-    Latency float64
+    Probe  string             `json:"probe"`
+    Type   string             `json:"type"`
+    Time   int64              `json:"time"` // unix nanoseconds
+    Status Status             `json:"status"`
+    Error  string             `json:"error,omitempty"`
+    Fields map[string]float64 `json:"fields,omitempty"`
+    Tags   map[string]string  `json:"tags,omitempty"`
+    // Text holds string values that vary too much to be tags, such as
+    // the routes of a path change.
+    Text map[string]string `json:"text,omitempty"`
+    // RTTs is the sorted list of individual round-trip times in ms,
+    // used to draw smokeping-style "smoke".
+    RTTs []float64 `json:"rtts,omitempty"`
 }
 
+// NewMetric returns a successful, empty metric stamped with the current time.
+func NewMetric(probe, typ string) Metric {
+    return Metric{
+        Probe:  probe,
+        Type:   typ,
+        Time:   time.Now().UnixNano(),
+        Status: StatusOK,
+        Fields: map[string]float64{},
+        Tags:   map[string]string{},
+    }
+}
+
+// Fail marks the metric as failed with err as the reason.
+func (m *Metric) Fail(err error) {
+    m.Status = StatusError
+    m.Error = err.Error()
+}
+
+// Timestamp returns the metric time as a time.Time.
+func (m Metric) Timestamp() time.Time {
+    return time.Unix(0, m.Time)
+}
+
+// Family returns the TagFamily value for an IPv6 or legacy IP address.
+func Family(ipv6 bool) string {
+    if ipv6 {
+        return "ipv6"
+    }
+    return "ipv4"
+}
+
+// Probe is one configured measurement. The daemon's scheduler calls Run
+// every Interval; ctx carries the deadline of the run, and a probe must
+// return by then, reporting whatever it got so far or a timeout failure.
 type Probe interface {
     Name() string
     Interval() time.Duration
-    Run(ctx context.Context, out chan<- Metric)
+    Run(ctx context.Context) []Metric
+}
+
+// ProbeLogger returns the logger for the probe configured by cfg, named
+// after its type and writing debug records if the probe has debug set.
+func ProbeLogger(cfg ProbeConfig) *logging.Logger {
+    return logging.New(cfg.Type).With("probe", cfg.Name).Debugging(cfg.Debug)
 }
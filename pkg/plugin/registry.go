@@ -2,21 +2,67 @@ package plugin
 
 import (
     "fmt"
+    "path/filepath"
+    "strings"
+
     "tokeping/pkg/config"
 )
 
 type ProbeConfig = config.ProbeConfig
 type OutputConfig = config.OutputConfig
 
+func init() {
+    config.RegisterCheck(validate)
+}
+
+// loading is set by EnableLoading.
+var loading bool
+
+// EnableLoading makes loading a config also load the plugins in its
+// plugin_dir. Only the commands that run probes, and validate when asked to,
+// call it, so that the others, such as stop and status, never run plugin
+// code.
+func EnableLoading() {
+    loading = true
+}
+
 var (
-    probeFactories  = make(map[string]func(ProbeConfig) (Probe, error))
-    outputFactories = make(map[string]func(OutputConfig) (Output, error))
+    probeFactories   = make(map[string]func(ProbeConfig) (Probe, error))
+    outputFactories  = make(map[string]func(OutputConfig) (Output, error))
+    probeValidators  = make(map[string]func(ProbeConfig) error)
+    outputValidators = make(map[string]func(OutputConfig) error)
 )
 
 func RegisterProbe(typ string, factory func(ProbeConfig) (Probe, error)) {
+    if staged != nil {
+        staged.probes[typ] = factory
+        return
+    }
     probeFactories[typ] = factory
 }
 
+// RegisterProbeValidator adds type-specific checks run by Validate. Unlike
+// the factory it must not have side effects such as opening sockets.
+func RegisterProbeValidator(typ string, validate func(ProbeConfig) error) {
+    if staged != nil {
+        staged.probeValidators[typ] = validate
+        return
+    }
+    probeValidators[typ] = validate
+}
+
+// ValidateProbe runs the checks of the probe's type on a single probe
+// config, for probes that don't come from a config file.
+func ValidateProbe(cfg ProbeConfig) error {
+    if _, ok := probeFactories[cfg.Type]; !ok {
+        return fmt.Errorf("unknown probe type: %s", cfg.Type)
+    }
+    if v, ok := probeValidators[cfg.Type]; ok {
+        return v(cfg)
+    }
+    return nil
+}
+
 func NewProbe(cfg ProbeConfig) (Probe, error) {
     f, ok := probeFactories[cfg.Type]
     if !ok {
@@ -26,9 +72,22 @@ func NewProbe(cfg ProbeConfig) (Probe, error) {
 }
 
 func RegisterOutput(typ string, factory func(OutputConfig) (Output, error)) {
+    if staged != nil {
+        staged.outputs[typ] = factory
+        return
+    }
     outputFactories[typ] = factory
 }
 
+// RegisterOutputValidator is the output counterpart of RegisterProbeValidator.
+func RegisterOutputValidator(typ string, validate func(OutputConfig) error) {
+    if staged != nil {
+        staged.outputValidators[typ] = validate
+        return
+    }
+    outputValidators[typ] = validate
+}
+
 func NewOutput(cfg OutputConfig) (Output, error) {
     f, ok := outputFactories[cfg.Type]
     if !ok {
@@ -36,3 +95,73 @@ func NewOutput(cfg OutputConfig) (Output, error) {
     }
     return f(cfg)
 }
+
+// Unchecked lists the probes and outputs of cfg whose types validation
+// skipped because they are not built in and plugin loading is disabled,
+// as a ValidationError with their lines, or returns nil if there are none.
+func Unchecked(cfg *config.Config) error {
+    if cfg.PluginDir == "" || loading {
+        return nil
+    }
+    verr := &config.ValidationError{File: cfg.File()}
+    for i, p := range cfg.Probes {
+        if _, ok := probeFactories[p.Type]; !ok {
+            verr.Add(cfg.Line(fmt.Sprintf("probes[%d]", i)),
+                "probe %q: type %q is not built in, assumed to come from plugin_dir", p.Name, p.Type)
+        }
+    }
+    for i, o := range cfg.Outputs {
+        if _, ok := outputFactories[o.Type]; !ok {
+            verr.Add(cfg.Line(fmt.Sprintf("outputs[%d]", i)),
+                "output %q: type %q is not built in, assumed to come from plugin_dir", o.Name, o.Type)
+        }
+    }
+    return verr.Err()
+}
+
+// validate loads the plugins of cfg's plugin_dir if loading is enabled,
+// then checks that every probe and output in cfg has a registered type and
+// passes that type's validator. Without loading, unknown types of a config
+// with a plugin_dir are assumed to come from its plugins and not checked;
+// Unchecked lists them.
+func validate(cfg *config.Config, verr *config.ValidationError) {
+    unloaded := cfg.PluginDir != "" && !loading
+    if dir := cfg.PluginDir; dir != "" && loading {
+        if !filepath.IsAbs(dir) {
+            dir = filepath.Join(filepath.Dir(cfg.File()), dir)
+        }
+        if err := LoadDir(dir); err != nil {
+            for _, e := range strings.Split(err.Error(), "\n") {
+                verr.Add(cfg.Line("plugin_dir"), "%s", e)
+            }
+        }
+    }
+    for i, p := range cfg.Probes {
+        line := cfg.Line(fmt.Sprintf("probes[%d]", i))
+        if _, ok := probeFactories[p.Type]; !ok {
+            if !unloaded {
+                verr.Add(line, "probe %q: unknown type %q", p.Name, p.Type)
+            }
+            continue
+        }
+        if v, ok := probeValidators[p.Type]; ok {
+            if err := v(p); err != nil {
+                verr.Add(line, "probe %q: %v", p.Name, err)
+            }
+        }
+    }
+    for i, o := range cfg.Outputs {
+        line := cfg.Line(fmt.Sprintf("outputs[%d]", i))
+        if _, ok := outputFactories[o.Type]; !ok {
+            if !unloaded {
+                verr.Add(line, "output %q: unknown type %q", o.Name, o.Type)
+            }
+            continue
+        }
+        if v, ok := outputValidators[o.Type]; ok {
+            if err := v(o); err != nil {
+                verr.Add(line, "output %q: %v", o.Name, err)
+            }
+        }
+    }
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tokeping/pkg/config"
+)
+
+func init() {
+	RegisterProbe("fake", func(ProbeConfig) (Probe, error) { return nil, nil })
+	RegisterProbeValidator("fake", func(cfg ProbeConfig) error {
+		if cfg.Target == "bad" {
+			return errors.New("bad target")
+		}
+		return nil
+	})
+}
+
+// loadConfig writes yaml to a config file in a new directory and loads it.
+func loadConfig(t *testing.T, yaml string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := config.Load(path)
+	return err
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		loading bool
+		yaml    string
+		errs    []string // substrings of the problems, in order
+	}{
+		{
+			name: "known types",
+			yaml: `
+probes:
+  - {name: a, type: fake, target: x, interval: 1m}
+  - {name: b, type: fake, target: bad, interval: 1m}
+`,
+			errs: []string{`:4: probe "b": bad target`},
+		},
+		{
+			name: "unknown types",
+			yaml: `
+probes:
+  - {name: a, type: mystery, target: x, interval: 1m}
+outputs:
+  - {name: out, type: mystery}
+`,
+			errs: []string{`:3: probe "a": unknown type "mystery"`, `:5: output "out": unknown type "mystery"`},
+		},
+		{
+			name: "plugin types not loaded",
+			yaml: `
+plugin_dir: missing
+probes:
+  - {name: a, type: mystery, target: x, interval: 1m}
+  - {name: b, type: fake, target: bad, interval: 1m}
+`,
+			errs: []string{`:5: probe "b": bad target`},
+		},
+		{
+			name:    "plugin types loaded",
+			loading: true,
+			yaml: `
+plugin_dir: missing
+probes:
+  - {name: a, type: mystery, target: x, interval: 1m}
+`,
+			errs: []string{":2: plugin directory: ", `:4: probe "a": unknown type "mystery"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loading = tt.loading
+			defer func() { loading = false }()
+
+			err := loadConfig(t, tt.yaml)
+			var got []string
+			if err != nil {
+				got = strings.Split(err.Error(), "\n")
+			}
+			if len(got) != len(tt.errs) {
+				t.Fatalf("got problems %q, want %q", got, tt.errs)
+			}
+			for i := range got {
+				if !strings.Contains(got[i], tt.errs[i]) {
+					t.Errorf("problem %q, want %q", got[i], tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRetriesUnopened(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.so")
+	if err := os.WriteFile(path, []byte("not a shared object"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := Load(path); err == nil {
+			t.Fatal("loaded a broken plugin")
+		}
+	}
+	if _, ok := loaded[path]; ok {
+		t.Error("the failed open was cached")
+	}
+}
+
+func TestUnchecked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := `
+probes:
+  - {name: a, type: pnig, target: x, interval: 1m}
+  - {name: b, type: fake, target: x, interval: 1m}
+outputs:
+  - {name: out, type: mystery}
+plugin_dir: plugins
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		path + `:3: probe "a": type "pnig" is not built in, assumed to come from plugin_dir`,
+		path + `:6: output "out": type "mystery" is not built in, assumed to come from plugin_dir`,
+	}
+	if err := Unchecked(cfg); err == nil || err.Error() != strings.Join(want, "\n") {
+		t.Errorf("Unchecked() = %v, want\n%s", err, strings.Join(want, "\n"))
+	}
+
+	// without a plugin_dir, unknown types are errors instead
+	noDir := *cfg
+	noDir.PluginDir = ""
+	if err := Unchecked(&noDir); err != nil {
+		t.Errorf("Unchecked() without plugin_dir = %v", err)
+	}
+	// loaded, the plugins' types were checked
+	loading = true
+	defer func() { loading = false }()
+	if err := Unchecked(cfg); err != nil {
+		t.Errorf("Unchecked() with loading = %v", err)
+	}
+}
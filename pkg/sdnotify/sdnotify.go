@@ -0,0 +1,44 @@
+// Package sdnotify tells systemd about the state of a Type=notify service,
+// using the sd_notify protocol.
+package sdnotify
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// States sent by the daemon.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+)
+
+// Reloading returns the state that announces a reload. systemd requires
+// the time the reload began with it, in microseconds of CLOCK_MONOTONIC.
+func Reloading() string {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return "RELOADING=1"
+	}
+	return fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000)
+}
+
+// Notify sends state, such as Ready, to the service manager. It does
+// nothing when tokeping was not started by systemd with a notify socket.
+func Notify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// a leading @ is an abstract socket, which net handles itself
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
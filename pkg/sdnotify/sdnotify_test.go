@@ -0,0 +1,70 @@
+package sdnotify
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// listen stands in for systemd's notify socket and returns the states
+// sent to it.
+func listen(t *testing.T) <-chan string {
+	t.Helper()
+	addr := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr)
+	ch := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		if err == nil {
+			ch <- string(buf[:n])
+		}
+	}()
+	return ch
+}
+
+func TestReloading(t *testing.T) {
+	got := listen(t)
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		t.Skip(err)
+	}
+	if err := Notify(Reloading()); err != nil {
+		t.Fatal(err)
+	}
+
+	var state string
+	select {
+	case state = <-got:
+	case <-time.After(time.Second):
+		t.Fatal("nothing sent")
+	}
+	lines := strings.Split(state, "\n")
+	if len(lines) != 2 || lines[0] != "RELOADING=1" || !strings.HasPrefix(lines[1], "MONOTONIC_USEC=") {
+		t.Fatalf("sent %q", state)
+	}
+	usec, err := strconv.ParseInt(strings.TrimPrefix(lines[1], "MONOTONIC_USEC="), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before := ts.Nano() / 1000; usec < before || usec > before+int64(time.Second/time.Microsecond) {
+		t.Errorf("MONOTONIC_USEC=%d, the clock read %d just before", usec, before)
+	}
+}
+
+func TestNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify(Ready); err != nil {
+		t.Error(err)
+	}
+}
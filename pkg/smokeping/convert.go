@@ -0,0 +1,466 @@
+package smokeping
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"tokeping/pkg/config"
+)
+
+// Smokeping's defaults when neither the probe nor the Database section
+// set them.
+const (
+	defaultStep  = 300 * time.Second
+	defaultPings = 20
+)
+
+// probeDef is an entry of the Probes section: a probe type such as FPing,
+// or a named instance of one ("++ FPing6" under "+ FPing").
+type probeDef struct {
+	name string
+	kind string // the smokeping probe module
+	vars map[string]Var
+	file string // where it is defined or first used, for reports
+	line int
+}
+
+// Cosmetic or smokeping-internal variables that have no tokeping
+// equivalent and are dropped without a report.
+var ignoredVars = map[string]bool{
+	"menu": true, "title": true, "remark": true, "nomasterpoll": true,
+	"binary": true, "forks": true, "offset": true, "slaves": true,
+	"parents": true, "hide": true, "menuextra": true,
+}
+
+// Converter translates a parsed smokeping config into a target tree,
+// collecting everything it could not translate in Report.
+type Converter struct {
+	Report []string
+
+	probes   map[string]probeDef
+	step     time.Duration
+	pings    int
+	reported map[string]bool
+}
+
+// Convert translates the Targets section of f, using its Probes and
+// Database sections for probe settings.
+func Convert(f *File) ([]config.TargetGroup, []string, error) {
+	targets, ok := f.Sections["Targets"]
+	if !ok {
+		return nil, nil, fmt.Errorf("no Targets section found")
+	}
+	c := &Converter{
+		probes:   make(map[string]probeDef),
+		step:     defaultStep,
+		pings:    defaultPings,
+		reported: make(map[string]bool),
+	}
+	if db, ok := f.Sections["Database"]; ok {
+		if v, ok := db.Vars["step"]; ok {
+			c.step = c.seconds(v, defaultStep)
+		}
+		if v, ok := db.Vars["pings"]; ok {
+			c.pings = c.int(v, defaultPings)
+		}
+	}
+	if probes, ok := f.Sections["Probes"]; ok {
+		c.rows(probes)
+		for _, n := range probes.Children {
+			c.probes[n.Name] = probeDef{name: n.Name, kind: n.Name, vars: n.Vars, file: n.File, line: n.Line}
+			for _, sub := range n.Children {
+				vars := make(map[string]Var, len(n.Vars)+len(sub.Vars))
+				for k, v := range n.Vars {
+					vars[k] = v
+				}
+				for k, v := range sub.Vars {
+					vars[k] = v
+				}
+				c.probes[sub.Name] = probeDef{name: sub.Name, kind: n.Name, vars: vars, file: sub.File, line: sub.Line}
+			}
+		}
+	}
+	if alerts, ok := f.Sections["Alerts"]; ok && len(alerts.Children) > 0 {
+		c.reportf(alerts.File, alerts.Line, "Alerts section not translated: tokeping has no alerting, use the prometheus or influxdb output")
+	}
+
+	c.rows(targets)
+	c.note(targets)
+	probe := ""
+	var root config.ProbeConfig
+	if v, ok := targets.Vars["probe"]; ok {
+		if def, ok := c.probeDef(v); ok {
+			probe = v.Value
+			root = c.defaults(def)
+		}
+	}
+	c.overrides(&root, targets, root.Type)
+	groups, loose := c.children(targets, targets.Vars, probe)
+	if len(loose) > 0 {
+		// tokeping needs targets inside a group
+		groups = append([]config.TargetGroup{{Name: "Targets", Targets: loose}}, groups...)
+	}
+	// tokeping has no root group; give its probe and the settings the
+	// top-level groups leave unset to them
+	for i := range groups {
+		inherit(&groups[i].Defaults, root)
+	}
+	c.uniqueNames(groups)
+	return groups, c.Report, nil
+}
+
+func (c *Converter) reportf(file string, line int, format string, args ...interface{}) {
+	msg := fmt.Sprintf("%s:%d: %s", file, line, fmt.Sprintf(format, args...))
+	if c.reported[msg] {
+		return
+	}
+	c.reported[msg] = true
+	c.Report = append(c.Report, msg)
+}
+
+// note reports the variables of n that have no tokeping equivalent.
+func (c *Converter) note(n *Node) {
+	for _, k := range n.Keys {
+		v := n.Vars[k]
+		switch {
+		case k == "alerts":
+			c.reportf(v.File, v.Line, "alerts = %s not translated: tokeping has no alerting", v.Value)
+		case ignoredVars[k], k == "probe", k == "host", targetVars[k], probeVars[k]:
+		default:
+			c.reportf(v.File, v.Line, "%s = %s not translated", k, v.Value)
+		}
+	}
+}
+
+// rows reports the lines of n and its subsections that are not
+// "key = value" settings, which Targets and Probes do not have.
+func (c *Converter) rows(n *Node) {
+	for _, r := range n.Rows {
+		c.reportf(r.File, r.Line, "cannot parse %q, skipped", r.Value)
+	}
+	for _, child := range n.Children {
+		c.rows(child)
+	}
+}
+
+// children converts the sub-sections of n. Sections with children become
+// groups, the others targets. vars holds the variables in effect at n
+// (smokeping passes every variable down the tree) and probe the probe the
+// group for n already selects in its defaults.
+func (c *Converter) children(n *Node, vars map[string]Var, probe string) ([]config.TargetGroup, []config.ProbeConfig) {
+	var groups []config.TargetGroup
+	var targets []config.ProbeConfig
+	for _, child := range n.Children {
+		c.note(child)
+		childVars := make(map[string]Var, len(vars)+len(child.Vars))
+		for k, v := range vars {
+			if k != "host" {
+				childVars[k] = v
+			}
+		}
+		for k, v := range child.Vars {
+			childVars[k] = v
+		}
+
+		if len(child.Children) == 0 {
+			if t, ok := c.target(child, childVars, probe); ok {
+				targets = append(targets, t)
+			}
+			continue
+		}
+
+		g := config.TargetGroup{Name: child.Name}
+		childProbe := probe
+		if v, ok := childVars["probe"]; ok && v.Value != probe {
+			if def, ok := c.probeDef(v); ok {
+				g.Defaults = c.defaults(def)
+				childProbe = v.Value
+			}
+		}
+		c.overrides(&g.Defaults, child, c.typeOf(childProbe))
+		if _, ok := child.Vars["host"]; ok {
+			// a section that is both a graph and a menu
+			if t, ok := c.target(child, childVars, childProbe); ok {
+				g.Targets = append(g.Targets, t)
+			}
+		}
+		subGroups, subTargets := c.children(child, childVars, childProbe)
+		g.Targets = append(g.Targets, subTargets...)
+		g.Groups = subGroups
+		if len(g.Groups) > 0 || len(g.Targets) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	return groups, targets
+}
+
+func (c *Converter) probeDef(v Var) (probeDef, bool) {
+	def, ok := c.probes[v.Value]
+	if !ok {
+		// a probe module used without a Probes entry
+		def = probeDef{name: v.Value, kind: v.Value, file: v.File, line: v.Line}
+	}
+	if _, ok := kinds[def.kind]; !ok {
+		c.reportf(v.File, v.Line, "probe %s (%s) has no tokeping equivalent; targets using it are skipped", def.name, def.kind)
+		return def, false
+	}
+	return def, true
+}
+
+// kinds maps smokeping probe modules to tokeping probe types.
+var kinds = map[string]string{
+	"FPing":           "ping",
+	"FPing6":          "ping",
+	"FPingContinuous": "ping",
+	"DNS":             "dns",
+	"AnotherDNS":      "dns",
+	"EchoPingDNS":     "dns",
+	"Curl":            "http",
+	"EchoPingHttp":    "http",
+	"EchoPingHttps":   "http",
+	"TCPPing":         "tcp",
+	"EchoPingSSH":     "tcp",
+	"SSH":             "tcp",
+}
+
+// Probe-module variables translated into group defaults.
+var probeVars = map[string]bool{"step": true, "pings": true, "timeout": true}
+
+// Target variables translated per target.
+var targetVars = map[string]bool{
+	"lookup": true, "server": true, "port": true, "urlformat": true,
+	"url": true, "expect": true, "recordtype": true,
+}
+
+// defaults turns a Probes entry into group defaults.
+func (c *Converter) defaults(def probeDef) config.ProbeConfig {
+	p := config.ProbeConfig{
+		Type:     kinds[def.kind],
+		Interval: c.step,
+	}
+	if def.kind == "FPing6" {
+		p.Family = "ipv6"
+	}
+	if p.Type == "ping" {
+		p.Pings = c.pings
+	}
+	keys := make([]string, 0, len(def.vars))
+	for k := range def.vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := def.vars[k]
+		switch k {
+		case "step":
+			p.Interval = c.seconds(v, c.step)
+		case "pings":
+			if p.Type == "ping" {
+				p.Pings = c.int(v, c.pings)
+			} else {
+				c.reportf(v.File, v.Line, "probe %s: pings = %s not translated, only ping probes send several pings per run", def.name, v.Value)
+			}
+		case "timeout":
+			p.Timeout = c.seconds(v, 0)
+		case "protocol":
+			if def.kind == "FPing" || def.kind == "FPing6" {
+				if v.Value == "6" {
+					p.Family = "ipv6"
+				} else if v.Value == "4" {
+					p.Family = "ipv4"
+				}
+				continue
+			}
+			c.reportf(v.File, v.Line, "probe %s: protocol = %s not translated", def.name, v.Value)
+		default:
+			if !ignoredVars[k] && !targetVars[k] {
+				c.reportf(v.File, v.Line, "probe %s: %s = %s not translated", def.name, k, v.Value)
+			}
+		}
+	}
+	if p.Type == "ping" && p.Interval <= time.Duration(p.Pings+1)*time.Second {
+		interval := time.Duration(p.Pings+1) * time.Second * 2
+		file, line := def.file, def.line
+		if v, ok := def.vars["step"]; ok {
+			file, line = v.File, v.Line
+		}
+		c.reportf(file, line, "probe %s: step %s is too short for a round of %d pings, using interval %s",
+			def.name, p.Interval, p.Pings, interval)
+		p.Interval = interval
+	}
+	return p
+}
+
+// typeOf returns the tokeping probe type of the smokeping probe called
+// name, "" if there is none.
+func (c *Converter) typeOf(name string) string {
+	if def, ok := c.probes[name]; ok {
+		return kinds[def.kind]
+	}
+	return kinds[name]
+}
+
+// overrides applies the probe settings smokeping allows on Targets
+// sections (step, pings, timeout) set directly on n. typ is the tokeping
+// type of the probe in effect at n; pings only applies to ping.
+func (c *Converter) overrides(p *config.ProbeConfig, n *Node, typ string) {
+	if v, ok := n.Vars["step"]; ok {
+		p.Interval = c.seconds(v, c.step)
+	}
+	if v, ok := n.Vars["pings"]; ok {
+		if typ == "ping" {
+			p.Pings = c.int(v, c.pings)
+		} else {
+			c.reportf(v.File, v.Line, "pings = %s not translated for %s, only ping probes send several pings per run", v.Value, n.Name)
+		}
+	}
+	if v, ok := n.Vars["timeout"]; ok {
+		p.Timeout = c.seconds(v, 0)
+	}
+}
+
+// target builds the target defined by n from its inherited variables.
+// groupProbe is the probe the enclosing group's defaults select; a target
+// using another one carries that probe's settings itself.
+func (c *Converter) target(n *Node, vars map[string]Var, groupProbe string) (config.ProbeConfig, bool) {
+	host, ok := vars["host"]
+	if !ok {
+		c.reportf(n.File, n.Line, "section %s has no host and no subsections, skipped", n.Name)
+		return config.ProbeConfig{}, false
+	}
+	pv, ok := vars["probe"]
+	if !ok {
+		c.reportf(host.File, host.Line, "target %s has no probe, skipped", n.Name)
+		return config.ProbeConfig{}, false
+	}
+	def, ok := c.probeDef(pv)
+	if !ok {
+		return config.ProbeConfig{}, false
+	}
+	// probe variables may also be set on targets
+	lookup := func(k string) (Var, bool) {
+		if v, ok := vars[k]; ok {
+			return v, true
+		}
+		v, ok := def.vars[k]
+		return v, ok
+	}
+
+	t := config.ProbeConfig{Name: n.Name}
+	if pv.Value != groupProbe {
+		d := c.defaults(def)
+		t.Type, t.Interval, t.Pings, t.Family, t.Timeout = d.Type, d.Interval, d.Pings, d.Family, d.Timeout
+	}
+	if strings.HasPrefix(host.Value, "/") {
+		// "host = /Group/target" multi-host graphs
+		c.reportf(host.File, host.Line, "multi-host target %s not translated", n.Name)
+		return t, false
+	}
+	switch kinds[def.kind] {
+	case "ping":
+		t.Target = host.Value
+	case "dns":
+		t.Target = "www.example.com"
+		if v, ok := lookup("lookup"); ok {
+			t.Target = v.Value
+		}
+		resolver := host.Value
+		if v, ok := lookup("server"); ok {
+			resolver = v.Value
+		}
+		t.Resolver = net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+		t.Protocol = "udp"
+		if v, ok := lookup("recordtype"); ok {
+			t.QueryType = v.Value
+		}
+	case "http":
+		scheme := "http"
+		if def.kind == "EchoPingHttps" {
+			scheme = "https"
+		}
+		url := scheme + "://%host%/"
+		if v, ok := lookup("urlformat"); ok {
+			url = v.Value
+		} else if v, ok := lookup("url"); ok {
+			url = scheme + "://%host%" + v.Value
+		}
+		t.Target = strings.ReplaceAll(url, "%host%", host.Value)
+		if v, ok := lookup("expect"); ok {
+			t.ExpectBody = v.Value
+		}
+	case "tcp":
+		port := "80"
+		if def.kind == "SSH" || def.kind == "EchoPingSSH" {
+			port = "22"
+		}
+		if v, ok := lookup("port"); ok {
+			port = v.Value
+		}
+		t.Target = net.JoinHostPort(strings.Trim(host.Value, "[]"), port)
+	}
+	c.overrides(&t, n, kinds[def.kind])
+	return t, true
+}
+
+// inherit fills in the settings of p left unset from defaults.
+func inherit(p *config.ProbeConfig, defaults config.ProbeConfig) {
+	if p.Type == "" {
+		p.Type = defaults.Type
+	}
+	if p.Interval == 0 {
+		p.Interval = defaults.Interval
+	}
+	if p.Pings == 0 && p.Type == "ping" {
+		p.Pings = defaults.Pings
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaults.Timeout
+	}
+	if p.Family == "" {
+		p.Family = defaults.Family
+	}
+}
+
+// uniqueNames renames targets whose name is used more than once to their
+// dotted smokeping path, since tokeping probe names must be unique.
+func (c *Converter) uniqueNames(groups []config.TargetGroup) {
+	count := make(map[string]int)
+	var walk func(gs []config.TargetGroup, fn func(t *config.ProbeConfig, path []string), path []string)
+	walk = func(gs []config.TargetGroup, fn func(t *config.ProbeConfig, path []string), path []string) {
+		for i := range gs {
+			p := append(path[:len(path):len(path)], gs[i].Name)
+			for j := range gs[i].Targets {
+				fn(&gs[i].Targets[j], p)
+			}
+			walk(gs[i].Groups, fn, p)
+		}
+	}
+	walk(groups, func(t *config.ProbeConfig, _ []string) { count[t.Name]++ }, nil)
+	walk(groups, func(t *config.ProbeConfig, path []string) {
+		if count[t.Name] > 1 {
+			t.Name = strings.Join(append(path, t.Name), ".")
+		}
+	}, nil)
+}
+
+func (c *Converter) seconds(v Var, fallback time.Duration) time.Duration {
+	n, err := strconv.Atoi(v.Value)
+	if err != nil || n <= 0 {
+		c.reportf(v.File, v.Line, "invalid number of seconds %q, using %s", v.Value, fallback)
+		return fallback
+	}
+	return time.Duration(n) * time.Second
+}
+
+func (c *Converter) int(v Var, fallback int) int {
+	n, err := strconv.Atoi(v.Value)
+	if err != nil || n <= 0 {
+		c.reportf(v.File, v.Line, "invalid number %q, using %d", v.Value, fallback)
+		return fallback
+	}
+	return n
+}
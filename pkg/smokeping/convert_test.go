@@ -0,0 +1,220 @@
+package smokeping
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tokeping/pkg/config"
+)
+
+func TestConvertStock(t *testing.T) {
+	f, err := Parse("testdata/config", "General")
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, report, err := Convert(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []config.TargetGroup{
+		{
+			Name:     "Local",
+			Defaults: config.ProbeConfig{Type: "ping", Interval: 5 * time.Minute, Pings: 20},
+			Targets:  []config.ProbeConfig{{Name: "LocalMachine", Target: "localhost"}},
+		},
+		{
+			Name:     "DNS",
+			Defaults: config.ProbeConfig{Type: "dns", Interval: 3 * time.Minute},
+			Targets: []config.ProbeConfig{
+				{Name: "Quad9", Target: "example.com", Resolver: "9.9.9.9:53", Protocol: "udp"},
+				{Name: "Cloudflare", Target: "www.example.com", Resolver: "1.1.1.1:53", Protocol: "udp"},
+			},
+		},
+		{
+			Name:     "Web",
+			Defaults: config.ProbeConfig{Type: "http", Interval: 5 * time.Minute, Timeout: 20 * time.Second},
+			Targets:  []config.ProbeConfig{{Name: "Example", Target: "https://www.example.com/status"}},
+		},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got  %+v\nwant %+v", groups, want)
+	}
+
+	// the Database RRAs and Presentation rows are not reported
+	wantReport := []string{
+		"testdata/config:23: Alerts section not translated: tokeping has no alerting, use the prometheus or influxdb output",
+		"testdata/Probes:12: probe DNS: pings = 5 not translated, only ping probes send several pings per run",
+		"testdata/config:132: pings = 5 not translated for Cloudflare, only ping probes send several pings per run",
+		"testdata/config:141: alerts = someloss not translated: tokeping has no alerting",
+	}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("report:\n%s\nwant:\n%s", strings.Join(report, "\n"), strings.Join(wantReport, "\n"))
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets string
+		probes  string
+		want    []config.TargetGroup
+		report  []string
+	}{
+		{
+			name: "sub-probe and loose target",
+			probes: `+ FPing
+++ FPing6
+protocol = 6
+`,
+			targets: `probe = FPing
++ v4
+host = 192.0.2.1
++ Six
+probe = FPing6
+++ v6
+host = 2001:db8::1
+`,
+			want: []config.TargetGroup{
+				{Name: "Targets", Defaults: config.ProbeConfig{Type: "ping", Interval: 5 * time.Minute, Pings: 20},
+					Targets: []config.ProbeConfig{{Name: "v4", Target: "192.0.2.1"}}},
+				{Name: "Six", Defaults: config.ProbeConfig{Type: "ping", Interval: 5 * time.Minute, Pings: 20, Family: "ipv6"},
+					Targets: []config.ProbeConfig{{Name: "v6", Target: "2001:db8::1"}}},
+			},
+		},
+		{
+			name:   "short step",
+			probes: "+ FPing\nstep = 10\n",
+			targets: `probe = FPing
++ G
+++ t
+host = 192.0.2.1
+`,
+			want: []config.TargetGroup{
+				{Name: "G", Defaults: config.ProbeConfig{Type: "ping", Interval: 42 * time.Second, Pings: 20},
+					Targets: []config.ProbeConfig{{Name: "t", Target: "192.0.2.1"}}},
+			},
+			report: []string{"Probes:2: probe FPing: step 10s is too short for a round of 20 pings, using interval 42s"},
+		},
+		{
+			name: "top-level group overrides",
+			targets: `probe = FPing
+timeout = 3
++ Slow
+step = 900
+pings = 10
+++ t
+host = 192.0.2.1
++ Plain
+++ u
+host = 192.0.2.2
+`,
+			want: []config.TargetGroup{
+				{Name: "Slow", Defaults: config.ProbeConfig{Type: "ping", Interval: 15 * time.Minute, Pings: 10, Timeout: 3 * time.Second},
+					Targets: []config.ProbeConfig{{Name: "t", Target: "192.0.2.1"}}},
+				{Name: "Plain", Defaults: config.ProbeConfig{Type: "ping", Interval: 5 * time.Minute, Pings: 20, Timeout: 3 * time.Second},
+					Targets: []config.ProbeConfig{{Name: "u", Target: "192.0.2.2"}}},
+			},
+		},
+		{
+			name: "pings on other probes",
+			targets: `probe = TCPPing
++ G
+pings = 5
+++ t
+host = 192.0.2.1
+pings = 3
+`,
+			want: []config.TargetGroup{
+				{Name: "G", Defaults: config.ProbeConfig{Type: "tcp", Interval: 5 * time.Minute},
+					Targets: []config.ProbeConfig{{Name: "t", Target: "192.0.2.1:80"}}},
+			},
+			report: []string{
+				"Targets:3: pings = 5 not translated for G, only ping probes send several pings per run",
+				"Targets:6: pings = 3 not translated for t, only ping probes send several pings per run",
+			},
+		},
+		{
+			name: "duplicate names",
+			targets: `probe = TCPPing
++ A
+++ web
+host = 192.0.2.1
++ B
+++ web
+host = 192.0.2.2
+port = 443
+`,
+			want: []config.TargetGroup{
+				{Name: "A", Defaults: config.ProbeConfig{Type: "tcp", Interval: 5 * time.Minute},
+					Targets: []config.ProbeConfig{{Name: "A.web", Target: "192.0.2.1:80"}}},
+				{Name: "B", Defaults: config.ProbeConfig{Type: "tcp", Interval: 5 * time.Minute},
+					Targets: []config.ProbeConfig{{Name: "B.web", Target: "192.0.2.2:443"}}},
+			},
+		},
+		{
+			name: "untranslated",
+			targets: `probe = FPing
+owner = me
++ G
+++ radius
+probe = Radius
+host = 192.0.2.1
+++ multi
+host = /G/radius
+++ empty
+this is not a setting
+`,
+			report: []string{
+				`Targets:10: cannot parse "this is not a setting", skipped`,
+				"Targets:2: owner = me not translated",
+				"Targets:5: probe Radius (Radius) has no tokeping equivalent; targets using it are skipped",
+				"Targets:8: multi-host target multi not translated",
+				"Targets:9: section empty has no host and no subsections, skipped",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			f := &File{Sections: map[string]*Node{}}
+			for _, in := range []struct{ section, content string }{{"Targets", tt.targets}, {"Probes", tt.probes}} {
+				if in.content == "" {
+					continue
+				}
+				path := filepath.Join(dir, in.section)
+				if err := os.WriteFile(path, []byte(in.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				parsed, err := Parse(path, in.section)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Merge(parsed)
+			}
+			groups, report, err := Convert(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(groups, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", groups, tt.want)
+			}
+			for i := range report {
+				report[i] = strings.TrimPrefix(report[i], dir+string(filepath.Separator))
+			}
+			if !reflect.DeepEqual(report, tt.report) {
+				t.Errorf("report:\n%s\nwant:\n%s", strings.Join(report, "\n"), strings.Join(tt.report, "\n"))
+			}
+		})
+	}
+}
+
+func TestConvertNoTargets(t *testing.T) {
+	if _, _, err := Convert(&File{Sections: map[string]*Node{}}); err == nil {
+		t.Error("converted a config without Targets")
+	}
+}
@@ -0,0 +1,176 @@
+// Package smokeping reads smokeping configuration files and translates
+// their Probes and Targets sections into a tokeping target tree.
+package smokeping
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Var is a "key = value" line, with where it was found.
+type Var struct {
+	Value string
+	File  string
+	Line  int
+}
+
+func (v Var) pos() string {
+	return fmt.Sprintf("%s:%d", v.File, v.Line)
+}
+
+// Node is a "+"-section of a smokeping file, or the implicit root of a
+// "*** Section ***".
+type Node struct {
+	Name     string
+	Vars     map[string]Var
+	Keys     []string // Vars keys in file order
+	Rows     []Var    // other lines, such as the RRA table of Database
+	Children []*Node
+	File     string
+	Line     int
+}
+
+// File is a parsed smokeping config: the root node of every
+// "*** Section ***" found, keyed by section name ("Targets", "Probes", ...).
+type File struct {
+	Sections map[string]*Node
+}
+
+var (
+	sectionRe = regexp.MustCompile(`^\*\*\*\s*(\w+)\s*\*\*\*\s*$`)
+	nodeRe    = regexp.MustCompile(`^(\++)\s*(\S+)`)
+	varRe     = regexp.MustCompile(`^([\w-]+)\s*=\s*(.*)$`)
+	includeRe = regexp.MustCompile(`^@include\s+(\S+)`)
+)
+
+// parser holds the state carried across @include boundaries.
+type parser struct {
+	file    *File
+	section string
+	stack   []*Node // stack[0] is the section root, stack[n] a depth-n node
+	seen    map[string]bool
+}
+
+// Parse reads a smokeping config file, following @include directives.
+// Content before any "*** Section ***" header is put in defaultSection,
+// so stand-alone Targets or Probes files can be read as well.
+func Parse(path, defaultSection string) (*File, error) {
+	p := &parser{
+		file: &File{Sections: make(map[string]*Node)},
+		seen: make(map[string]bool),
+	}
+	p.enter(defaultSection, path, 0)
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.file, nil
+}
+
+// enter switches to section name, creating its root node if needed.
+func (p *parser) enter(name, file string, line int) {
+	root, ok := p.file.Sections[name]
+	if !ok {
+		root = &Node{Name: name, Vars: make(map[string]Var), File: file, Line: line}
+		p.file.Sections[name] = root
+	}
+	p.section = name
+	p.stack = []*Node{root}
+}
+
+func (p *parser) parseFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if p.seen[abs] {
+		return fmt.Errorf("%s: @include loop", path)
+	}
+	p.seen[abs] = true
+	defer delete(p.seen, abs)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// a trailing backslash continues the line, as in long remarks
+		start := lineNo
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNo++
+			line = strings.TrimSpace(strings.TrimSuffix(line, "\\")) + " " + strings.TrimSpace(scanner.Text())
+		}
+
+		if m := sectionRe.FindStringSubmatch(line); m != nil {
+			p.enter(m[1], path, start)
+			continue
+		}
+		if m := includeRe.FindStringSubmatch(line); m != nil {
+			inc := m[1]
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(path), inc)
+			}
+			if err := p.parseFile(inc); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, start, err)
+			}
+			continue
+		}
+		if m := nodeRe.FindStringSubmatch(line); m != nil {
+			depth := len(m[1])
+			if depth > len(p.stack) {
+				return fmt.Errorf("%s:%d: section %q nested too deep (%d '+' under depth %d)",
+					path, start, m[2], depth, len(p.stack)-1)
+			}
+			n := &Node{Name: m[2], Vars: make(map[string]Var), File: path, Line: start}
+			parent := p.stack[depth-1]
+			parent.Children = append(parent.Children, n)
+			p.stack = append(p.stack[:depth], n)
+			continue
+		}
+		if m := varRe.FindStringSubmatch(line); m != nil {
+			n := p.stack[len(p.stack)-1]
+			if _, ok := n.Vars[m[1]]; !ok {
+				n.Keys = append(n.Keys, m[1])
+			}
+			n.Vars[m[1]] = Var{Value: strings.TrimSpace(m[2]), File: path, Line: start}
+			continue
+		}
+		// table rows (Database RRAs, Presentation time spans) have no
+		// "key = value" form; Convert reports those where it matters
+		n := p.stack[len(p.stack)-1]
+		n.Rows = append(n.Rows, Var{Value: line, File: path, Line: start})
+	}
+	return scanner.Err()
+}
+
+// Merge adds the sections of other to f. Nodes of a section present in
+// both are appended, and variables of other's root win.
+func (f *File) Merge(other *File) {
+	for name, root := range other.Sections {
+		mine, ok := f.Sections[name]
+		if !ok {
+			f.Sections[name] = root
+			continue
+		}
+		for _, k := range root.Keys {
+			if _, ok := mine.Vars[k]; !ok {
+				mine.Keys = append(mine.Keys, k)
+			}
+			mine.Vars[k] = root.Vars[k]
+		}
+		mine.Rows = append(mine.Rows, root.Rows...)
+		mine.Children = append(mine.Children, root.Children...)
+	}
+}
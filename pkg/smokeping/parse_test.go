@@ -0,0 +1,115 @@
+package smokeping
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	f, err := Parse("testdata/config", "General")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"General", "Alerts", "Database", "Presentation", "Probes", "Targets"} {
+		if _, ok := f.Sections[name]; !ok {
+			t.Errorf("missing section %s", name)
+		}
+	}
+
+	db := f.Sections["Database"]
+	if v := db.Vars["step"]; v.Value != "300" || v.Line != 35 {
+		t.Errorf("Database step = %+v, want 300 at line 35", v)
+	}
+	if len(db.Rows) != 7 || db.Rows[0].Value != "AVERAGE  0.5   1  1008" || db.Rows[0].Line != 40 {
+		t.Errorf("Database rows = %+v, want the 7 RRAs from line 40", db.Rows)
+	}
+	detail := f.Sections["Presentation"].Children[2]
+	if detail.Name != "detail" || len(detail.Rows) != 4 || detail.Vars["height"].Value != "200" {
+		t.Errorf("Presentation detail = %+v, want height and 4 time spans", detail)
+	}
+
+	// @include Probes
+	probes := f.Sections["Probes"]
+	var names []string
+	for _, n := range probes.Children {
+		names = append(names, n.Name)
+	}
+	if got := strings.Join(names, " "); got != "FPing DNS Curl" {
+		t.Errorf("probes %q, want FPing DNS Curl", got)
+	}
+	fping6 := probes.Children[0].Children[0]
+	if fping6.Name != "FPing6" || fping6.File != filepath.Join("testdata", "Probes") || fping6.Line != 5 {
+		t.Errorf("FPing6 at %s:%d, want testdata/Probes:5", fping6.File, fping6.Line)
+	}
+	if v := fping6.Vars["protocol"]; v.Value != "6" || v.Line != 7 {
+		t.Errorf("FPing6 protocol = %+v", v)
+	}
+
+	targets := f.Sections["Targets"]
+	remark := targets.Vars["remark"]
+	if !strings.HasSuffix(remark.Value, "xxx Company. Here you will learn all about the latency of our network.") || remark.Line != 104 {
+		t.Errorf("continued remark = %+v", remark)
+	}
+	if len(targets.Rows) != 0 {
+		t.Errorf("unexpected Targets rows %+v", targets.Rows)
+	}
+	dns := targets.Children[1]
+	if dns.Name != "DNS" || len(dns.Children) != 2 || dns.Children[1].Vars["host"].Value != "1.1.1.1" {
+		t.Errorf("DNS section = %+v", dns)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name:  "too deep",
+			files: map[string]string{"Targets": "+ A\n+++ B\n"},
+			err:   `Targets:2: section "B" nested too deep`,
+		},
+		{
+			name:  "include loop",
+			files: map[string]string{"Targets": "@include Other\n", "Other": "@include Targets\n"},
+			err:   "@include loop",
+		},
+		{
+			name:  "missing include",
+			files: map[string]string{"Targets": "probe = FPing\n@include Missing\n"},
+			err:   "Targets:2: open",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := Parse(filepath.Join(dir, "Targets"), "Targets")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	main, err := Parse("testdata/config", "General")
+	if err != nil {
+		t.Fatal(err)
+	}
+	probes, err := Parse("testdata/Probes", "Probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	main.Merge(probes)
+	if n := len(main.Sections["Probes"].Children); n != 6 {
+		t.Errorf("got %d probes after merge, want 6", n)
+	}
+}
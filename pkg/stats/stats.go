@@ -0,0 +1,50 @@
+// Package stats holds tokeping's own health counters. The daemon updates
+// them and outputs such as prometheus export them.
+package stats
+
+import "sync"
+
+// CounterVec is a set of monotonically increasing counters keyed by name.
+type CounterVec struct {
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+func newCounterVec() *CounterVec {
+	return &CounterVec{m: make(map[string]uint64)}
+}
+
+// Inc adds one to the counter for key.
+func (c *CounterVec) Inc(key string) {
+	c.mu.Lock()
+	c.m[key]++
+	c.mu.Unlock()
+}
+
+// Snapshot returns a copy of all counters.
+func (c *CounterVec) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snap := make(map[string]uint64, len(c.m))
+	for k, v := range c.m {
+		snap[k] = v
+	}
+	return snap
+}
+
+var (
+	// ProbeResults counts metrics received from each probe.
+	ProbeResults = newCounterVec()
+	// ProbeErrors counts failed metrics from each probe.
+	ProbeErrors = newCounterVec()
+	// ProbeTimeouts counts runs of each probe that hit their deadline.
+	ProbeTimeouts = newCounterVec()
+	// ProbeOverruns counts runs of each probe that took longer than the
+	// interval.
+	ProbeOverruns = newCounterVec()
+	// ProbeSkipped counts runs of each probe that were skipped because the
+	// previous one had not finished.
+	ProbeSkipped = newCounterVec()
+	// OutputDropped counts metrics each output discarded on a full queue.
+	OutputDropped = newCounterVec()
+)
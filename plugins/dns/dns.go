@@ -3,19 +3,40 @@ package dns
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"strings"
 	"time"
 
+	"tokeping/pkg/logging"
 	"tokeping/pkg/plugin"
 
 	"github.com/miekg/dns"
 )
 
+const defaultTimeout = 5 * time.Second
+
+// EDNS0 buffer size used when only dnssec_ok is set, the DNS flag day 2020
+// recommendation.
+const defaultEDNSBufSize = 1232
+
+// Fields and tags added by the dns probe.
+const (
+	FieldAnswers = "answers" // records in the answer section
+	FieldTTL     = "ttl"     // lowest TTL in the answer section, seconds
+	FieldSize    = "size"    // response size, bytes
+
+	// Set on udp queries: 1 if the answer was truncated and retried over
+	// tcp, with the time the tcp query took. rtt stays the udp time.
+	FieldTCPFallback = "tcp_fallback"
+	FieldFallbackRTT = "fallback_rtt"
+
+	TagQueryType = "qtype"
+)
+
 // extractHostname strips the “:port” so TLS ServerName is correct
 func extractHostname(addr string) string {
 	host, _, err := net.SplitHostPort(addr)
@@ -26,20 +47,102 @@ func extractHostname(addr string) string {
 }
 
 type DNSProbe struct {
-	name       string
-	target     string
-	interval   time.Duration
-	protocol   string
-	resolver   string
-	dohURL     string
-	udpRes     *net.Resolver
-	tcpRes     *net.Resolver
-	dotClient  *dns.Client
+	name      string
+	target    string
+	interval  time.Duration
+	protocol  string
+	resolver  string
+	dohURL    string
+	dohMethod string
+
+	httpVersion     string // doh: the version the server must use
+	freshConnection bool   // doh: new connection every query
+
+	qtype        uint16
+	expectRcode  int
+	expectAnswer map[string]bool
+	ednsBufSize  uint16 // 0 for no EDNS0
+	dnssecOK     bool
+	dnssec       bool     // validate the answer
+	anchors      []dns.RR // DS or DNSKEY records of the trust anchor zone
+
+	client     *dns.Client // udp, tcp and dot
+	tcpClient  *dns.Client // udp truncation fallback
 	httpClient *http.Client
+	log        *logging.Logger
 }
 
 func init() {
 	plugin.RegisterProbe("dns", New)
+	plugin.RegisterProbeValidator("dns", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+	switch strings.ToLower(cfg.Protocol) {
+	case "", "udp":
+		if cfg.Resolver != "" {
+			if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+				return fmt.Errorf("resolver must be host:port: %v", err)
+			}
+		}
+	case "tcp", "dot":
+		if cfg.Resolver == "" {
+			return fmt.Errorf("protocol %s needs a resolver", cfg.Protocol)
+		}
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			return fmt.Errorf("resolver must be host:port: %v", err)
+		}
+	case "doh":
+		u, err := url.Parse(cfg.DoHURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("protocol doh needs an https:// or http:// doh_url")
+		}
+		if err := validateDoH(cfg); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q (want udp, tcp, dot or doh)", cfg.Protocol)
+	}
+	if _, err := queryType(cfg.QueryType); err != nil {
+		return err
+	}
+	if _, err := rcode(cfg.ExpectRcode); err != nil {
+		return err
+	}
+	if _, err := trustAnchors(cfg.TrustAnchor); err != nil {
+		return err
+	}
+	if cfg.EDNSBufSize != 0 && (cfg.EDNSBufSize < 512 || cfg.EDNSBufSize > 65535) {
+		return fmt.Errorf("edns_buffer_size %d out of range (512-65535)", cfg.EDNSBufSize)
+	}
+	for _, a := range cfg.ExpectAnswer {
+		if strings.TrimSpace(a) == "" {
+			return fmt.Errorf("expect_answer must not contain empty answers")
+		}
+	}
+	return nil
+}
+
+func queryType(s string) (uint16, error) {
+	if s == "" {
+		return dns.TypeA, nil
+	}
+	t, ok := dns.StringToType[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown query_type %q", s)
+	}
+	return t, nil
+}
+
+func rcode(s string) (int, error) {
+	if s == "" {
+		return dns.RcodeSuccess, nil
+	}
+	rc, ok := dns.StringToRcode[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown expect_rcode %q", s)
+	}
+	return rc, nil
 }
 
 func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
@@ -47,40 +150,75 @@ func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
 	if proto == "" {
 		proto = "udp"
 	}
+	qtype, err := queryType(cfg.QueryType)
+	if err != nil {
+		return nil, err
+	}
+	expectRcode, err := rcode(cfg.ExpectRcode)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
 
 	dp := &DNSProbe{
-		name:     cfg.Name,
-		target:   cfg.Target,
-		interval: cfg.Interval,
-		protocol: strings.ToLower(proto),
-		resolver: cfg.Resolver,
-		dohURL:   cfg.DoHURL,
+		name:            cfg.Name,
+		target:          cfg.Target,
+		interval:        cfg.Interval,
+		protocol:        strings.ToLower(proto),
+		resolver:        cfg.Resolver,
+		dohURL:          cfg.DoHURL,
+		dohMethod:       strings.ToLower(cfg.DoHMethod),
+		httpVersion:     cfg.HTTPVersion,
+		freshConnection: cfg.FreshConnection,
+		qtype:           qtype,
+		expectRcode:     expectRcode,
+		ednsBufSize:     uint16(cfg.EDNSBufSize),
+		dnssecOK:        cfg.DNSSECOK || cfg.DNSSEC,
+		dnssec:          cfg.DNSSEC,
+		log:             plugin.ProbeLogger(cfg),
 	}
-
-	// Default UDP resolver
-	dp.udpRes = net.DefaultResolver
-
-	// TCP resolver over the configured address
-	dp.tcpRes = &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{Timeout: 2 * time.Second}
-			return d.DialContext(ctx, "tcp", dp.resolver)
-		},
+	if dp.dnssec {
+		if dp.anchors, err = trustAnchors(cfg.TrustAnchor); err != nil {
+			return nil, err
+		}
 	}
-
-	// DoT client with proper SNI
-	dp.dotClient = &dns.Client{
-		Net:     "tcp-tls",
-		Timeout: 5 * time.Second,
-		TLSConfig: &tls.Config{
-			ServerName:         extractHostname(cfg.Resolver),
-			InsecureSkipVerify: false,
-		},
+	if dp.dnssecOK && dp.ednsBufSize == 0 {
+		dp.ednsBufSize = defaultEDNSBufSize
+	}
+	if len(cfg.ExpectAnswer) > 0 {
+		dp.expectAnswer = make(map[string]bool)
+		for _, a := range cfg.ExpectAnswer {
+			dp.expectAnswer[normalize(a)] = true
+		}
 	}
 
-	// DoH HTTP client
-	dp.httpClient = &http.Client{Timeout: 5 * time.Second}
+	switch dp.protocol {
+	case "udp":
+		if dp.resolver == "" {
+			if dp.resolver, err = systemResolver(); err != nil {
+				return nil, err
+			}
+		}
+		dp.client = &dns.Client{Net: "udp", Timeout: timeout, UDPSize: dp.ednsBufSize}
+		dp.tcpClient = &dns.Client{Net: "tcp", Timeout: timeout}
+	case "tcp":
+		dp.client = &dns.Client{Net: "tcp", Timeout: timeout}
+	case "dot":
+		// DoT client with proper SNI
+		dp.client = &dns.Client{
+			Net:     "tcp-tls",
+			Timeout: timeout,
+			TLSConfig: &tls.Config{
+				ServerName:         extractHostname(cfg.Resolver),
+				InsecureSkipVerify: false,
+			},
+		}
+	case "doh":
+		dp.httpClient = newDoHClient(cfg, timeout)
+	}
 
 	return dp, nil
 }
@@ -88,81 +226,137 @@ func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
 func (p *DNSProbe) Name() string            { return p.name }
 func (p *DNSProbe) Interval() time.Duration { return p.interval }
 
-func (p *DNSProbe) Run(ctx context.Context, out chan<- plugin.Metric) {
-	ticker := time.NewTicker(p.interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			start := time.Now()
-			var err error
-
-			switch p.protocol {
-			case "udp":
-				_, err = p.udpRes.LookupHost(ctx, p.target)
-
-			case "tcp":
-				_, err = p.tcpRes.LookupHost(ctx, p.target)
-
-			case "dot":
-				m := new(dns.Msg)
-				m.SetQuestion(dns.Fqdn(p.target), dns.TypeA)
-				fmt.Fprintf(os.Stderr, "⏱ DoT query %s → %s\n", p.target, p.resolver)
-				_, rtt, err2 := p.dotClient.ExchangeContext(ctx, m, p.resolver)
-				if err2 != nil {
-					err = err2
-					fmt.Fprintf(os.Stderr, "❌ DoT error: %v\n", err)
-				} else {
-					// use the measured round-trip time
-					elapsed := rtt
-					out <- plugin.Metric{
-						Probe:   p.name,
-						Time:    time.Now().Unix(),
-						Latency: elapsed.Seconds() * 1000,
-					}
-					continue
-				}
-
-			case "doh":
-				req, _ := http.NewRequestWithContext(ctx, "GET", p.dohURL, nil)
-				q := req.URL.Query()
-				q.Set("name", p.target)
-				q.Set("type", "A")
-				req.URL.RawQuery = q.Encode()
-				req.Header.Set("Accept", "application/dns-json")
-
-				resp, err2 := p.httpClient.Do(req)
-				if err2 != nil {
-					err = err2
-					fmt.Fprintf(os.Stderr, "❌ DoH error: %v\n", err)
-				} else {
-					defer resp.Body.Close()
-					var result struct{ Answer []interface{} }
-					if err2 = json.NewDecoder(resp.Body).Decode(&result); err2 != nil {
-						err = err2
-						fmt.Fprintf(os.Stderr, "❌ DoH parse error: %v\n", err)
-					}
-				}
-
-			default:
-				err = fmt.Errorf("unknown DNS protocol: %s", p.protocol)
-			}
+func (p *DNSProbe) Run(ctx context.Context) []plugin.Metric {
+	return []plugin.Metric{p.query(ctx)}
+}
 
-			// Fallback for udp, tcp, doh, or dot errors
-			elapsed := time.Since(start)
-			ms := elapsed.Seconds() * 1000
-			if err != nil {
-				ms = -1
-			}
+// query asks the resolver once and checks the response against the
+// expected rcode and answers.
+func (p *DNSProbe) query(ctx context.Context) plugin.Metric {
+	m := plugin.NewMetric(p.name, "dns")
+	m.Tags[plugin.TagTarget] = p.target
+	m.Tags[plugin.TagProtocol] = p.protocol
+	m.Tags[TagQueryType] = dns.TypeToString[p.qtype]
+	if p.protocol == "doh" {
+		m.Tags[plugin.TagResolver] = p.dohURL
+	} else {
+		m.Tags[plugin.TagResolver] = p.resolver
+		m.Tags[plugin.TagFamily] = plugin.Family(isIPv6(extractHostname(p.resolver)))
+	}
 
-			out <- plugin.Metric{
-				Probe:   p.name,
-				Time:    time.Now().Unix(),
-				Latency: ms,
-			}
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(p.target), p.qtype)
+	if p.ednsBufSize > 0 {
+		msg.SetEdns0(p.ednsBufSize, p.dnssecOK)
+	}
+
+	resp, rtt, err := p.exchange(ctx, &m, msg)
+	if err != nil {
+		p.log.Warn("query failed", "resolver", m.Tags[plugin.TagResolver], "err", err)
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+
+	m.Fields[plugin.FieldRTT] = rtt.Seconds() * 1000
+	m.Fields[FieldSize] = float64(resp.Len())
+	if p.log.Enabled(logging.LevelDebug) {
+		p.log.Debug("got response", "resolver", m.Tags[plugin.TagResolver], "rtt", rtt, "response", resp.String())
+	}
+	if p.dnssec {
+		if err := p.validateDNSSEC(ctx, &m, msg, resp); err != nil {
+			m.Fail(err)
+			return m
+		}
+	}
+	if err := p.check(&m, resp); err != nil {
+		m.Fail(err)
+	}
+	return m
+}
+
+// exchange sends msg with the probe's protocol, recording protocol
+// specific details such as a udp truncation fallback in m.
+func (p *DNSProbe) exchange(ctx context.Context, m *plugin.Metric, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if p.protocol == "doh" {
+		return p.queryDoH(ctx, m, msg)
+	}
+	resp, rtt, err := p.client.ExchangeContext(ctx, msg, p.resolver)
+	if p.protocol == "udp" && err == nil {
+		m.Fields[FieldTCPFallback] = 0
+		if resp.Truncated {
+			// rtt stays the udp time; the full answer comes over tcp
+			var tcpRTT time.Duration
+			m.Fields[FieldTCPFallback] = 1
+			resp, tcpRTT, err = p.tcpClient.ExchangeContext(ctx, msg, p.resolver)
+			m.Fields[FieldFallbackRTT] = tcpRTT.Seconds() * 1000
 		}
 	}
+	return resp, rtt, err
+}
+
+// check records rcode, answer count and TTL of resp in m, and returns why
+// resp is not the expected answer, if it is not. With expect_answer set,
+// every record of the queried type must be one of the expected answers,
+// so a hijacked or stale answer fails even if the right one is there too.
+func (p *DNSProbe) check(m *plugin.Metric, resp *dns.Msg) error {
+	m.Fields[plugin.FieldRcode] = float64(resp.Rcode)
+	m.Fields[FieldAnswers] = float64(len(resp.Answer))
+	for i, rr := range resp.Answer {
+		if ttl := float64(rr.Header().Ttl); i == 0 || ttl < m.Fields[FieldTTL] {
+			m.Fields[FieldTTL] = ttl
+		}
+	}
+
+	if resp.Rcode != p.expectRcode {
+		return fmt.Errorf("rcode %s, expected %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[p.expectRcode])
+	}
+	if p.expectAnswer == nil {
+		return nil
+	}
+	matched := 0
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != p.qtype {
+			continue // CNAMEs on the way
+		}
+		got := normalize(strings.TrimPrefix(rr.String(), rr.Header().String()))
+		if !p.expectAnswer[got] {
+			return fmt.Errorf("unexpected %s answer %q", dns.TypeToString[p.qtype], got)
+		}
+		matched++
+	}
+	if matched == 0 {
+		return fmt.Errorf("no %s answer", dns.TypeToString[p.qtype])
+	}
+	return nil
+}
+
+// normalize puts an answer in a form that can be compared: addresses in
+// canonical form, names lower case without the trailing dot, TXT without
+// the quotes.
+func normalize(s string) string {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(s, `"`), "."))
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf, for
+// when no resolver is configured.
+func systemResolver() (string, error) {
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(conf.Servers) == 0 {
+		return "", errors.New("no resolver configured and no nameserver in /etc/resolv.conf")
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// isIPv6 reports whether host is an IPv6 literal.
+func isIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
 }
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+)
+
+func TestQuery(t *testing.T) {
+	addr := zoneServer(t)
+	tests := []struct {
+		name   string
+		target string
+		rcode  string
+		expect []string
+		proto  string
+		err    string // "" for ok
+		fields map[string]float64
+	}{
+		{
+			name:   "answer",
+			target: "www.example.com",
+			fields: map[string]float64{plugin.FieldRcode: 0, FieldAnswers: 3, FieldTTL: 300, FieldTCPFallback: 0},
+		},
+		{
+			name:   "expected answers",
+			target: "www.example.com",
+			expect: []string{"192.0.2.1", "192.0.2.2", "192.0.2.99"},
+		},
+		{
+			name:   "wrong answer",
+			target: "www.example.com",
+			expect: []string{"192.0.2.1"},
+			err:    `unexpected A answer "192.0.2.2"`,
+		},
+		{
+			name:   "no answer",
+			target: "ns9.example.com",
+			expect: []string{"192.0.2.1"},
+			err:    "no A answer",
+		},
+		{
+			name:   "nxdomain",
+			target: "nx.example.com",
+			err:    "rcode NXDOMAIN, expected NOERROR",
+			fields: map[string]float64{plugin.FieldRcode: 3, FieldAnswers: 0},
+		},
+		{
+			name:   "expected nxdomain",
+			target: "nx.example.com",
+			rcode:  "nxdomain",
+		},
+		{
+			name:   "servfail",
+			target: "broken.example.com",
+			rcode:  "NXDOMAIN",
+			err:    "rcode SERVFAIL, expected NXDOMAIN",
+		},
+		{
+			name:   "truncated",
+			target: "big.example.com",
+			expect: []string{"192.0.2.3"},
+			fields: map[string]float64{FieldAnswers: 1, FieldTCPFallback: 1},
+		},
+		{
+			name:   "tcp",
+			target: "big.example.com",
+			proto:  "tcp",
+			fields: map[string]float64{FieldAnswers: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, err := New(plugin.ProbeConfig{
+				Name:         "test",
+				Type:         "dns",
+				Target:       tt.target,
+				Interval:     time.Minute,
+				Timeout:      time.Second,
+				Resolver:     addr,
+				Protocol:     tt.proto,
+				ExpectRcode:  tt.rcode,
+				ExpectAnswer: tt.expect,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := pr.Run(context.Background())[0]
+			if tt.err == "" && m.Status != plugin.StatusOK {
+				t.Errorf("status %s: %s", m.Status, m.Error)
+			}
+			if tt.err != "" && (m.Status == plugin.StatusOK || m.Error != tt.err) {
+				t.Errorf("status %s, error %q, want %q", m.Status, m.Error, tt.err)
+			}
+			for name, want := range tt.fields {
+				if got, ok := m.Fields[name]; !ok || got != want {
+					t.Errorf("field %s = %v (set %v), want %v", name, got, ok, want)
+				}
+			}
+			if _, ok := m.Fields[FieldTCPFallback]; ok == (tt.proto == "tcp") {
+				t.Errorf("tcp_fallback set %v over %s", ok, m.Tags[plugin.TagProtocol])
+			}
+			if _, ok := m.Fields[FieldFallbackRTT]; ok != (m.Fields[FieldTCPFallback] == 1) {
+				t.Errorf("fallback_rtt set %v with tcp_fallback %v", ok, m.Fields[FieldTCPFallback])
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		" 192.0.2.1 ":        "192.0.2.1",
+		"2001:DB8:0::1":      "2001:db8::1",
+		"Mail.Example.COM.":  "mail.example.com",
+		`"v=spf1 -all"`:      "v=spf1 -all",
+		"10 mx.example.com.": "10 mx.example.com",
+	} {
+		if got := normalize(in); got != want {
+			t.Errorf("normalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
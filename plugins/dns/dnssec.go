@@ -0,0 +1,342 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation results, in the TagDNSSEC tag.
+const (
+	TagDNSSEC = "dnssec"
+
+	DNSSECSecure        = "secure"
+	DNSSECInsecure      = "insecure"      // no signatures, or no DS at a delegation
+	DNSSECBogus         = "bogus"         // a signature or the chain of trust is broken
+	DNSSECIndeterminate = "indeterminate" // the chain could not be fetched
+)
+
+// Fields added in dnssec mode.
+const (
+	FieldAD         = "ad"          // 1 if the resolver set the AD flag
+	FieldExpiryDays = "expiry_days" // until the first signature of the answer's zone expires
+)
+
+// The root zone KSKs, KSK-2017 and KSK-2024, as published by IANA.
+var rootAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBF683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// trustAnchors parses DS or DNSKEY records, all for the same zone. No
+// records means the root zone.
+func trustAnchors(records []string) ([]dns.RR, error) {
+	if len(records) == 0 {
+		records = rootAnchors
+	}
+	var anchors []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("trust_anchor %q: %v", s, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return nil, fmt.Errorf("trust_anchor %q is not a DS or DNSKEY record", s)
+		}
+		if len(anchors) > 0 && !strings.EqualFold(rr.Header().Name, anchors[0].Header().Name) {
+			return nil, fmt.Errorf("trust_anchor records must all be for the same zone")
+		}
+		anchors = append(anchors, rr)
+	}
+	return anchors, nil
+}
+
+var errInsecure = errors.New("insecure")
+
+type bogusError struct{ msg string }
+
+func (e *bogusError) Error() string { return e.msg }
+
+func bogus(format string, args ...interface{}) error {
+	return &bogusError{fmt.Sprintf(format, args...)}
+}
+
+// validateDNSSEC checks the chain of trust of resp, the answer to msg, and
+// records the result in m. Only a secure answer passes.
+func (p *DNSProbe) validateDNSSEC(ctx context.Context, m *plugin.Metric, msg, resp *dns.Msg) error {
+	m.Fields[FieldAD] = 0
+	if resp.AuthenticatedData {
+		m.Fields[FieldAD] = 1
+	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		// a validating resolver answers SERVFAIL to bogus data; ask for
+		// the data itself to tell bogus from a broken resolver
+		cd := msg.Copy()
+		cd.CheckingDisabled = true
+		scratch := plugin.NewMetric(p.name, "dns")
+		if r, _, err := p.exchange(ctx, &scratch, cd); err == nil && r.Rcode != dns.RcodeServerFailure {
+			resp = r
+		}
+	}
+
+	v := &validator{p: p, now: time.Now(), keys: make(map[string][]*dns.DNSKEY), expiry: make(map[string]time.Time)}
+	zone, err := v.validate(ctx, resp)
+	var be *bogusError
+	switch {
+	case err == nil:
+		m.Tags[TagDNSSEC] = DNSSECSecure
+		m.Fields[FieldExpiryDays] = v.expiry[zone].Sub(v.now).Hours() / 24
+		return nil
+	case errors.Is(err, errInsecure):
+		m.Tags[TagDNSSEC] = DNSSECInsecure
+		return fmt.Errorf("dnssec %v", err)
+	case errors.As(err, &be):
+		m.Tags[TagDNSSEC] = DNSSECBogus
+		return fmt.Errorf("dnssec bogus: %v", err)
+	default:
+		m.Tags[TagDNSSEC] = DNSSECIndeterminate
+		return fmt.Errorf("dnssec indeterminate: %v", err)
+	}
+}
+
+// validator follows one answer's chain of trust up to the trust anchor,
+// asking the probe's resolver for the DNSKEY and DS records on the way.
+type validator struct {
+	p      *DNSProbe
+	now    time.Time
+	keys   map[string][]*dns.DNSKEY // validated keys by zone
+	expiry map[string]time.Time     // first signature expiry by zone
+}
+
+// validate checks every RRset of the answer section, or of the authority
+// section for an empty answer, and returns the zone that signed them.
+// Denial of existence is checked for valid signatures only, not for what
+// the NSEC or NSEC3 records prove.
+func (v *validator) validate(ctx context.Context, resp *dns.Msg) (string, error) {
+	section := resp.Answer
+	if len(section) == 0 {
+		section = resp.Ns
+	}
+	if len(section) == 0 {
+		return "", errors.New("nothing to validate in the response")
+	}
+
+	rrsets, sigs := split(section)
+	if len(sigs) == 0 {
+		return "", fmt.Errorf("%w: response is not signed", errInsecure)
+	}
+	zone := ""
+	for _, rrset := range rrsets {
+		signer, err := v.verify(ctx, rrset, sigs)
+		if err != nil {
+			return "", err
+		}
+		if signer = strings.ToLower(signer); zone == "" || dns.CountLabel(signer) > dns.CountLabel(zone) {
+			zone = signer
+		}
+	}
+	return zone, nil
+}
+
+// split groups records by name and type, and returns the RRSIGs apart.
+func split(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	var sigs []*dns.RRSIG
+	index := make(map[string]int)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+			continue
+		}
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+	return rrsets, sigs
+}
+
+// verify checks that one of sigs over rrset is valid and made with a
+// validated key of its signer, and returns the signer.
+func (v *validator) verify(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) (string, error) {
+	h := rrset[0].Header()
+	var covering []*dns.RRSIG
+	for _, sig := range sigs {
+		if sig.TypeCovered == h.Rrtype && strings.EqualFold(sig.Hdr.Name, h.Name) {
+			covering = append(covering, sig)
+		}
+	}
+	if len(covering) == 0 {
+		return "", bogus("%s %s has no signature", h.Name, dns.TypeToString[h.Rrtype])
+	}
+
+	var lastErr error
+	for _, sig := range covering {
+		if !dns.IsSubDomain(sig.SignerName, h.Name) {
+			lastErr = bogus("%s signed by %s, which is not its zone", h.Name, sig.SignerName)
+			continue
+		}
+		keys, err := v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			return "", err
+		}
+		if err := v.check(sig, keys, rrset); err != nil {
+			lastErr = err
+			continue
+		}
+		return sig.SignerName, nil
+	}
+	return "", lastErr
+}
+
+// check verifies sig over rrset with the matching one of keys.
+func (v *validator) check(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	name := fmt.Sprintf("%s %s", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+	if !sig.ValidityPeriod(v.now) {
+		return bogus("signature over %s by key %d is expired or not yet valid", name, sig.KeyTag)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			return bogus("signature over %s by key %d: %v", name, sig.KeyTag, err)
+		}
+		zone := strings.ToLower(sig.SignerName)
+		if exp := time.Unix(int64(sig.Expiration), 0); v.expiry[zone].IsZero() || exp.Before(v.expiry[zone]) {
+			v.expiry[zone] = exp
+		}
+		return nil
+	}
+	return bogus("no key %d in %s for the signature over %s", sig.KeyTag, sig.SignerName, name)
+}
+
+// zoneKeys returns the DNSKEYs of zone once the DNSKEY RRset is signed by
+// a key that the trust anchor, or a validated DS in the parent, vouches for.
+func (v *validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	anchorZone := strings.ToLower(v.p.anchors[0].Header().Name)
+	if !dns.IsSubDomain(anchorZone, zone) {
+		return nil, fmt.Errorf("%s is outside the trust anchor %s", zone, anchorZone)
+	}
+
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dns.DNSKEY
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, bogus("%s has no DNSKEY", zone)
+	}
+
+	var ds []dns.RR
+	if zone == anchorZone {
+		ds = v.p.anchors
+	} else if ds, err = v.delegation(ctx, zone); err != nil {
+		return nil, err
+	}
+
+	// the keys the DS records (or anchor keys) point at may sign the set
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, rr := range ds {
+			switch a := rr.(type) {
+			case *dns.DS:
+				if d := key.ToDS(a.DigestType); d != nil && d.KeyTag == a.KeyTag && strings.EqualFold(d.Digest, a.Digest) {
+					trusted = append(trusted, key)
+				}
+			case *dns.DNSKEY:
+				if key.PublicKey == a.PublicKey && key.Algorithm == a.Algorithm {
+					trusted = append(trusted, key)
+				}
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, bogus("no DNSKEY of %s matches its DS or trust anchor", zone)
+	}
+	var lastErr error = bogus("DNSKEY set of %s is not signed by a trusted key", zone)
+	for _, sig := range sigs {
+		if err := v.check(sig, trusted, rrset); err != nil {
+			lastErr = err
+			continue
+		}
+		v.keys[zone] = keys
+		return keys, nil
+	}
+	return nil, lastErr
+}
+
+// delegation returns the validated DS records of zone, signed in its
+// parent. No DS means an insecure delegation.
+func (v *validator) delegation(ctx context.Context, zone string) ([]dns.RR, error) {
+	resp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, sigs := split(resp.Answer)
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype != dns.TypeDS {
+			continue
+		}
+		for _, sig := range sigs {
+			// the DS set is signed by the parent, never by zone itself
+			if strings.EqualFold(sig.SignerName, zone) {
+				return nil, bogus("DS of %s signed by itself", zone)
+			}
+		}
+		if _, err := v.verify(ctx, rrset, sigs); err != nil {
+			return nil, err
+		}
+		return rrset, nil
+	}
+	return nil, fmt.Errorf("%w: no DS for %s", errInsecure, zone)
+}
+
+// query asks the probe's resolver for name and type with the DO and CD
+// bits set, so the records come back even if the resolver thinks them bogus.
+func (v *validator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.SetEdns0(v.p.ednsBufSize, true)
+	msg.CheckingDisabled = true
+	scratch := plugin.NewMetric(v.p.name, "dns")
+	resp, _, err := v.p.exchange(ctx, &scratch, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
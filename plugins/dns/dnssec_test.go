@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"context"
+	"crypto"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// signer is a zone with a single key signing everything in it.
+type signer struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSigner(t *testing.T, name string) *signer {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 300},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signer{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the signature over rrset valid from inception to expiration.
+func (s *signer) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: 300},
+		Algorithm:  s.key.Algorithm,
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(s.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	t.Helper()
+	r, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// signedServer answers with the records stored under "name/TYPE" in
+// records, and with an empty NOERROR answer for anything else.
+func signedServer(t *testing.T, records map[string][]dns.RR) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		q := r.Question[0]
+		reply.Answer = records[strings.ToLower(q.Name)+"/"+dns.TypeToString[q.Qtype]]
+		w.WriteMsg(reply)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestDNSSEC(t *testing.T) {
+	now := time.Now()
+	valid := now.Add(10 * 24 * time.Hour)
+	soon := now.Add(5 * 24 * time.Hour)
+	root := newSigner(t, "example.")
+	secure := newSigner(t, "secure.example.")
+	unsigned := newSigner(t, "unsigned.example.")
+
+	records := make(map[string][]dns.RR)
+	// add stores rrset under its name and type, signed by s
+	add := func(s *signer, rrset []dns.RR, inception, expiration time.Time) {
+		h := rrset[0].Header()
+		key := strings.ToLower(h.Name) + "/" + dns.TypeToString[h.Rrtype]
+		records[key] = append(append([]dns.RR(nil), rrset...), s.sign(t, rrset, inception, expiration))
+	}
+	for _, s := range []*signer{root, secure, unsigned} {
+		add(s, []dns.RR{s.key}, now.Add(-time.Hour), valid)
+	}
+	// only secure.example. is delegated with a DS
+	add(root, []dns.RR{secure.key.ToDS(dns.SHA256)}, now.Add(-time.Hour), valid)
+
+	add(secure, []dns.RR{rr(t, "www.secure.example. 300 IN A 192.0.2.1")}, now.Add(-time.Hour), soon)
+	add(secure, []dns.RR{rr(t, "old.secure.example. 300 IN A 192.0.2.3")}, now.Add(-20*24*time.Hour), now.Add(-time.Hour))
+	add(unsigned, []dns.RR{rr(t, "www.unsigned.example. 300 IN A 192.0.2.4")}, now.Add(-time.Hour), valid)
+	// a signature made over other data than is served
+	add(secure, []dns.RR{rr(t, "bad.secure.example. 300 IN A 192.0.2.9")}, now.Add(-time.Hour), valid)
+	records["bad.secure.example./A"][0] = rr(t, "bad.secure.example. 300 IN A 192.0.2.2")
+	// a zone whose DS does not match its key
+	forged := newSigner(t, "forged.example.")
+	add(forged, []dns.RR{forged.key}, now.Add(-time.Hour), valid)
+	ds := secure.key.ToDS(dns.SHA256)
+	ds.Hdr.Name = "forged.example."
+	add(root, []dns.RR{ds}, now.Add(-time.Hour), valid)
+	add(forged, []dns.RR{rr(t, "www.forged.example. 300 IN A 192.0.2.5")}, now.Add(-time.Hour), valid)
+	records["plain.example./A"] = []dns.RR{rr(t, "plain.example. 300 IN A 192.0.2.6")}
+
+	addr := signedServer(t, records)
+	tests := []struct {
+		target string
+		want   string
+		err    string
+	}{
+		{"www.secure.example", DNSSECSecure, ""},
+		{"bad.secure.example", DNSSECBogus, "signature over bad.secure.example. A by key"},
+		{"old.secure.example", DNSSECBogus, "expired or not yet valid"},
+		{"www.unsigned.example", DNSSECInsecure, "no DS for unsigned.example."},
+		{"www.forged.example", DNSSECBogus, "no DNSKEY of forged.example. matches its DS"},
+		{"plain.example", DNSSECInsecure, "response is not signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			pr, err := New(plugin.ProbeConfig{
+				Name:        "test",
+				Type:        "dns",
+				Target:      tt.target,
+				Interval:    time.Minute,
+				Timeout:     time.Second,
+				Resolver:    addr,
+				DNSSEC:      true,
+				TrustAnchor: []string{root.key.ToDS(dns.SHA256).String()},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := pr.Run(context.Background())[0]
+			if got := m.Tags[TagDNSSEC]; got != tt.want {
+				t.Errorf("dnssec %q (%s), want %q", got, m.Error, tt.want)
+			}
+			if tt.err == "" {
+				if m.Status != plugin.StatusOK {
+					t.Errorf("status %s: %s", m.Status, m.Error)
+				}
+				// the answer's signature expires before the keys'
+				want := soon.Sub(now).Hours() / 24
+				if got := m.Fields[FieldExpiryDays]; math.Abs(got-want) > 0.01 {
+					t.Errorf("expiry_days %v, want %v", got, want)
+				}
+				return
+			}
+			if m.Status == plugin.StatusOK || !strings.Contains(m.Error, tt.err) {
+				t.Errorf("status %s, error %q, want one containing %q", m.Status, m.Error, tt.err)
+			}
+			if _, ok := m.Fields[FieldExpiryDays]; ok {
+				t.Errorf("expiry_days set on a %s answer", tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustAnchors(t *testing.T) {
+	anchors, err := trustAnchors(nil)
+	if err != nil || len(anchors) != 2 || anchors[0].Header().Name != "." {
+		t.Errorf("default anchors %v, %v", anchors, err)
+	}
+	for _, bad := range [][]string{
+		{"example. IN A 192.0.2.1"},
+		{"not a record"},
+		{". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBF683457104237C7F8EC8D",
+			"example. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBF683457104237C7F8EC8D"},
+	} {
+		if _, err := trustAnchors(bad); err == nil {
+			t.Errorf("trustAnchors(%q) succeeded", bad)
+		}
+	}
+}
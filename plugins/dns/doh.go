@@ -0,0 +1,182 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const dohMediaType = "application/dns-message"
+
+// Fields added by doh queries. rtt is the query time on an established
+// connection, without the setup.
+const (
+	FieldSetup      = "setup"  // dns, connect and tls time of a new connection, ms
+	FieldReused     = "reused" // 1 if an idle connection was reused
+	FieldHTTPStatus = "http_status"
+)
+
+// Largest DNS message, RFC 1035 over TCP and RFC 8484 alike.
+const maxMessageSize = 65535
+
+func validateDoH(cfg plugin.ProbeConfig) error {
+	switch strings.ToLower(cfg.DoHMethod) {
+	case "", "get", "post":
+	default:
+		return fmt.Errorf("unknown doh_method %q (want get or post)", cfg.DoHMethod)
+	}
+	switch cfg.HTTPVersion {
+	case "", "1.1":
+	case "2", "3":
+		if u, err := url.Parse(cfg.DoHURL); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("http_version %s needs an https:// doh_url", cfg.HTTPVersion)
+		}
+	default:
+		return fmt.Errorf("unknown http_version %q (want 1.1, 2 or 3)", cfg.HTTPVersion)
+	}
+	return nil
+}
+
+// newDoHClient returns the client for doh queries. Unless every query gets
+// a fresh connection, idle connections are kept for longer than the
+// interval so the next run can reuse them.
+func newDoHClient(cfg plugin.ProbeConfig, timeout time.Duration) *http.Client {
+	if cfg.HTTPVersion == "3" {
+		transport := &http3.RoundTripper{
+			TLSClientConfig: &tls.Config{},
+			QuicConfig:      &quic.Config{MaxIdleTimeout: cfg.Interval + 30*time.Second},
+			Dial:            dialQUIC,
+		}
+		return &http.Client{Transport: transport, Timeout: timeout}
+	}
+	transport := &http.Transport{
+		DisableKeepAlives: cfg.FreshConnection,
+		IdleConnTimeout:   cfg.Interval + 30*time.Second,
+		TLSClientConfig:   &tls.Config{},
+		ForceAttemptHTTP2: true,
+	}
+	switch cfg.HTTPVersion {
+	case "1.1":
+		// a non-nil, empty map disables HTTP/2 negotiation
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case "2":
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// dialQUIC opens an HTTP/3 connection and, as http3 does not, reports it
+// to the request's httptrace like net/http does for TCP connections.
+func dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+	conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+	if err != nil {
+		return nil, err
+	}
+	// the setup time includes the whole handshake, as with TLS over TCP
+	select {
+	case <-conn.HandshakeComplete():
+	case <-ctx.Done():
+		conn.CloseWithError(0, "")
+		return nil, ctx.Err()
+	}
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{})
+	}
+	return conn, nil
+}
+
+// queryDoH sends msg as an RFC 8484 GET or POST and returns the answer and
+// the query time, recording the connection setup and HTTP status in m.
+func (p *DNSProbe) queryDoH(ctx context.Context, m *plugin.Metric, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 4.1: ID 0 keeps GET requests cacheable
+	msg.Id = 0
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var start, gotConn time.Time
+	var reused bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			gotConn = time.Now()
+			reused = info.Reused
+		},
+	})
+
+	var req *http.Request
+	if p.dohMethod == "post" {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, p.dohURL, bytes.NewReader(wire))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	} else {
+		u := strings.TrimSuffix(p.dohURL, "{?dns}")
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "dns=" + base64.RawURLEncoding.EncodeToString(wire)
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	start = time.Now()
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	end := time.Now()
+	if p.freshConnection {
+		// http3 has no way to turn keep-alives off
+		p.httpClient.CloseIdleConnections()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if gotConn.IsZero() {
+		// http3 only reports new connections
+		gotConn, reused = start, true
+	}
+
+	m.Fields[FieldHTTPStatus] = float64(resp.StatusCode)
+	m.Fields[FieldSetup] = gotConn.Sub(start).Seconds() * 1000
+	m.Fields[FieldReused] = 0
+	if reused {
+		m.Fields[FieldReused] = 1
+	}
+	if p.httpVersion == "2" && resp.ProtoMajor != 2 || p.httpVersion == "3" && resp.ProtoMajor != 3 {
+		return nil, 0, fmt.Errorf("DoH server did not negotiate HTTP/%s, got %s", p.httpVersion, resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct != dohMediaType {
+		return nil, 0, fmt.Errorf("DoH server returned %q, not %s", ct, dohMediaType)
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, 0, fmt.Errorf("parsing DoH answer: %w", err)
+	}
+	return reply, end.Sub(gotConn), nil
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// dohHandler answers every A query with 192.0.2.1.
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+	if r.Method == http.MethodPost {
+		wire, err = io.ReadAll(r.Body)
+	} else {
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	}
+	query := new(dns.Msg)
+	if err == nil {
+		err = query.Unpack(wire)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(query)
+	rr, _ := dns.NewRR(query.Question[0].Name + " 300 IN A 192.0.2.1")
+	reply.Answer = append(reply.Answer, rr)
+	b, _ := reply.Pack()
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(b)
+}
+
+// h3Server serves dohHandler over HTTP/3 with the certificate of srv, and
+// returns its doh_url.
+func h3Server(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h3 := &http3.Server{
+		Handler:   http.HandlerFunc(dohHandler),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates}),
+	}
+	go h3.Serve(conn)
+	t.Cleanup(func() {
+		h3.Close()
+		conn.Close()
+	})
+	return "https://" + conn.LocalAddr().String() + "/dns-query"
+}
+
+// newDoHProbe returns a doh probe for cfg that trusts the certificate of
+// srv, if it has one.
+func newDoHProbe(t *testing.T, srv *httptest.Server, cfg plugin.ProbeConfig) *DNSProbe {
+	t.Helper()
+	cfg.Name, cfg.Type, cfg.Interval = "test", "dns", time.Minute
+	cfg.Target, cfg.Protocol = "example.com", "doh"
+	cfg.ExpectAnswer = []string{"192.0.2.1"}
+	if err := validate(cfg); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	pr, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	p := pr.(*DNSProbe)
+	t.Cleanup(p.httpClient.CloseIdleConnections)
+	if srv.TLS == nil {
+		return p
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	switch tr := p.httpClient.Transport.(type) {
+	case *http.Transport:
+		tr.TLSClientConfig.RootCAs = pool
+	case *http3.RoundTripper:
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	return p
+}
+
+func TestDoH(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(dohHandler))
+	defer plain.Close()
+	h1 := httptest.NewTLSServer(http.HandlerFunc(dohHandler))
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(dohHandler))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h3URL := h3Server(t, h2)
+
+	tests := []struct {
+		name    string
+		srv     *httptest.Server
+		url     string // default srv's
+		version string
+		method  string
+		fresh   bool
+		ok      bool
+	}{
+		{name: "plain http", srv: plain, ok: true},
+		{name: "get", srv: h2, ok: true},
+		{name: "post", srv: h2, method: "post", ok: true},
+		{name: "fresh connection", srv: h2, fresh: true, ok: true},
+		{name: "forced 1.1", srv: h2, version: "1.1", ok: true},
+		{name: "h2", srv: h2, version: "2", ok: true},
+		{name: "h2 without server support", srv: h1, version: "2", ok: false},
+		{name: "h3", srv: h2, url: h3URL, version: "3", ok: true},
+		{name: "h3 post", srv: h2, url: h3URL, version: "3", method: "post", ok: true},
+		{name: "h3 fresh connection", srv: h2, url: h3URL, version: "3", fresh: true, ok: true},
+		{name: "h3 without server support", srv: h2, version: "3", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url
+			if url == "" {
+				url = tt.srv.URL + "/dns-query"
+			}
+			p := newDoHProbe(t, tt.srv, plugin.ProbeConfig{
+				DoHURL:          url,
+				DoHMethod:       tt.method,
+				HTTPVersion:     tt.version,
+				FreshConnection: tt.fresh,
+				Timeout:         time.Second,
+			})
+
+			for run := 0; run < 2; run++ {
+				m := p.query(context.Background())
+				if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+					t.Fatalf("run %d: status %s (%s), want ok=%v", run, m.Status, m.Error, tt.ok)
+				}
+				if !tt.ok {
+					return
+				}
+				if m.Fields[FieldHTTPStatus] != 200 || m.Fields[FieldAnswers] != 1 {
+					t.Errorf("run %d: fields %v", run, m.Fields)
+				}
+				// the second run reuses the connection unless asked not to
+				wantReused := float64(0)
+				if run == 1 && !tt.fresh {
+					wantReused = 1
+				}
+				if m.Fields[FieldReused] != wantReused {
+					t.Errorf("run %d: reused = %v, want %v", run, m.Fields[FieldReused], wantReused)
+				}
+				if setup := m.Fields[FieldSetup]; setup < 0 || wantReused == 0 && setup == 0 {
+					t.Errorf("run %d: setup = %v", run, setup)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDoH(t *testing.T) {
+	tests := []struct {
+		url, version, method string
+		ok                   bool
+	}{
+		{"https://dns.example/dns-query", "", "", true},
+		{"https://dns.example/dns-query", "3", "post", true},
+		{"https://dns.example/dns-query", "2", "", true},
+		{"http://127.0.0.1:8053/dns-query", "", "", true},
+		{"http://127.0.0.1:8053/dns-query", "2", "", false},
+		{"http://127.0.0.1:8053/dns-query", "3", "", false},
+		{"https://dns.example/dns-query", "4", "", false},
+		{"https://dns.example/dns-query", "", "put", false},
+		{"dns.example", "", "", false},
+	}
+	for _, tt := range tests {
+		cfg := plugin.ProbeConfig{Protocol: "doh", DoHURL: tt.url, HTTPVersion: tt.version, DoHMethod: tt.method}
+		if err := validate(cfg); (err == nil) != tt.ok {
+			t.Errorf("doh_url %s, http_version %q, doh_method %q: %v, want ok=%v", tt.url, tt.version, tt.method, err, tt.ok)
+		}
+	}
+}
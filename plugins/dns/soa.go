@@ -0,0 +1,323 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// Fields and tags of the soa probe.
+const (
+	TagServer = "server" // nameserver name, on per-server metrics
+
+	FieldSerial    = "serial"      // per server, and the newest on the summary
+	FieldServers   = "servers"     // addresses queried, and names whose address lookup failed
+	FieldAnswered  = "answered"    // addresses that answered authoritatively
+	FieldSerials   = "serials"     // distinct serials seen
+	FieldOutOfSync = "out_of_sync" // 1 if not every answer has the newest serial
+	FieldSerialLag = "serial_lag"  // newest serial minus the oldest one seen
+)
+
+// SOAProbe asks every authoritative server of a zone for its SOA and
+// compares the serials. It emits one metric per server address and a
+// summary metric without the server tag.
+type SOAProbe struct {
+	name        string
+	zone        string
+	interval    time.Duration
+	family      string // "" for both
+	nameservers []string
+	resolver    string // for NS and address lookups
+	client      *dns.Client
+	tcpClient   *dns.Client
+	log         *logging.Logger
+}
+
+// nameserver is one address of an authoritative server, or a server whose
+// addresses could not be looked up.
+type nameserver struct {
+	name string
+	addr string // host:port
+	err  error  // of the address lookup; addr is empty
+}
+
+func init() {
+	plugin.RegisterProbe("soa", NewSOA)
+	plugin.RegisterProbeValidator("soa", validateSOA)
+}
+
+func validateSOA(cfg plugin.ProbeConfig) error {
+	if cfg.Resolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			return fmt.Errorf("resolver must be host:port: %v", err)
+		}
+	}
+	switch cfg.Family {
+	case "", "ipv6", "ipv4":
+	default:
+		return fmt.Errorf("unknown address family %q (want ipv6 or ipv4)", cfg.Family)
+	}
+	for _, ns := range cfg.Nameservers {
+		if strings.TrimSpace(ns) == "" {
+			return fmt.Errorf("nameservers must not contain empty entries")
+		}
+	}
+	return nil
+}
+
+func NewSOA(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	p := &SOAProbe{
+		name:        cfg.Name,
+		zone:        dns.Fqdn(cfg.Target),
+		interval:    cfg.Interval,
+		family:      cfg.Family,
+		nameservers: cfg.Nameservers,
+		resolver:    cfg.Resolver,
+		client:      &dns.Client{Net: "udp", Timeout: timeout},
+		tcpClient:   &dns.Client{Net: "tcp", Timeout: timeout},
+		log:         plugin.ProbeLogger(cfg),
+	}
+	if p.resolver == "" {
+		var err error
+		if p.resolver, err = systemResolver(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *SOAProbe) Name() string            { return p.name }
+func (p *SOAProbe) Interval() time.Duration { return p.interval }
+
+func (p *SOAProbe) Run(ctx context.Context) []plugin.Metric {
+	return p.compare(ctx)
+}
+
+// compare queries all servers at once and returns their metrics followed
+// by the summary.
+func (p *SOAProbe) compare(ctx context.Context) []plugin.Metric {
+	summary := plugin.NewMetric(p.name, "soa")
+	summary.Tags[plugin.TagTarget] = strings.TrimSuffix(p.zone, ".")
+
+	servers, err := p.servers(ctx)
+	if err == nil && len(servers) == 0 {
+		err = fmt.Errorf("no nameserver addresses for %s", p.zone)
+	}
+	if err != nil {
+		p.log.Warn("nameserver lookup failed", "zone", p.zone, "err", err)
+		summary.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		summary.Fail(err)
+		return []plugin.Metric{summary}
+	}
+
+	metrics := make([]plugin.Metric, len(servers))
+	var wg sync.WaitGroup
+	for i := range servers {
+		wg.Add(1)
+		go func(i int, ns nameserver) {
+			defer wg.Done()
+			metrics[i] = p.query(ctx, ns)
+		}(i, servers[i])
+	}
+	wg.Wait()
+
+	var serials []uint32
+	for _, m := range metrics {
+		if m.Status == plugin.StatusOK {
+			serials = append(serials, uint32(m.Fields[FieldSerial]))
+		}
+	}
+	summary.Fields[FieldServers] = float64(len(servers))
+	summary.Fields[FieldAnswered] = float64(len(serials))
+	if len(serials) == 0 {
+		summary.Fail(errors.New("no authoritative server answered"))
+		return append(metrics, summary)
+	}
+
+	newest, lag, distinct := compareSerials(serials)
+	summary.Fields[FieldSerial] = float64(newest)
+	summary.Fields[FieldSerials] = float64(distinct)
+	summary.Fields[FieldSerialLag] = float64(lag)
+	summary.Fields[FieldOutOfSync] = 0
+	if distinct > 1 {
+		summary.Fields[FieldOutOfSync] = 1
+	}
+	return append(metrics, summary)
+}
+
+// compareSerials returns the newest serial in RFC 1982 serial number
+// arithmetic, how far the oldest one is behind it, and how many distinct
+// serials there are.
+func compareSerials(serials []uint32) (newest, lag uint32, distinct int) {
+	seen := make(map[uint32]bool)
+	newest = serials[0]
+	for _, s := range serials {
+		seen[s] = true
+		if int32(s-newest) > 0 {
+			newest = s
+		}
+	}
+	for _, s := range serials {
+		if newest-s > lag {
+			lag = newest - s
+		}
+	}
+	return newest, lag, len(seen)
+}
+
+// query asks one server for the SOA, without recursion.
+func (p *SOAProbe) query(ctx context.Context, ns nameserver) plugin.Metric {
+	m := plugin.NewMetric(p.name, "soa")
+	m.Tags[plugin.TagTarget] = strings.TrimSuffix(p.zone, ".")
+	m.Tags[TagServer] = strings.TrimSuffix(ns.name, ".")
+	if ns.err != nil {
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(ns.err)
+		m.Fail(ns.err)
+		return m
+	}
+	m.Tags[plugin.TagAddr] = ns.addr
+	m.Tags[plugin.TagFamily] = plugin.Family(isIPv6(extractHostname(ns.addr)))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(p.zone, dns.TypeSOA)
+	msg.RecursionDesired = false
+
+	resp, rtt, err := p.client.ExchangeContext(ctx, msg, ns.addr)
+	if err == nil && resp.Truncated {
+		resp, _, err = p.tcpClient.ExchangeContext(ctx, msg, ns.addr)
+	}
+	if err != nil {
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+	m.Fields[plugin.FieldRTT] = rtt.Seconds() * 1000
+	m.Fields[plugin.FieldRcode] = float64(resp.Rcode)
+	if p.log.Enabled(logging.LevelDebug) {
+		p.log.Debug("got response", "server", ns.name, "addr", ns.addr, "rtt", rtt, "response", resp.String())
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		m.Fail(fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode]))
+		return m
+	}
+	if !resp.Authoritative {
+		m.Fail(fmt.Errorf("%s is not authoritative for %s (lame delegation)", ns.name, p.zone))
+		return m
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			m.Fields[FieldSerial] = float64(soa.Serial)
+			return m
+		}
+	}
+	m.Fail(fmt.Errorf("no SOA in the answer"))
+	return m
+}
+
+// servers returns every address of the configured nameservers, or of the
+// zone's NS records if none are configured. A server whose addresses cannot
+// be looked up is returned with the error, so the others are still checked.
+func (p *SOAProbe) servers(ctx context.Context) ([]nameserver, error) {
+	names := p.nameservers
+	if len(names) == 0 {
+		resp, err := p.lookup(ctx, p.zone, dns.TypeNS)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range resp.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				names = append(names, ns.Ns)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no NS records for %s", p.zone)
+		}
+		sort.Strings(names)
+	}
+
+	var servers []nameserver
+	for _, entry := range names {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			host, port = entry, "53"
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			servers = append(servers, nameserver{name: host, addr: net.JoinHostPort(host, port)})
+			continue
+		}
+		addrs, err := p.addresses(ctx, dns.Fqdn(host))
+		for _, ip := range addrs {
+			servers = append(servers, nameserver{name: host, addr: net.JoinHostPort(ip, port)})
+		}
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		if err != nil {
+			p.log.Warn("nameserver address lookup failed", "zone", p.zone, "server", host, "err", err)
+			servers = append(servers, nameserver{name: host, err: err})
+		}
+	}
+	return servers, nil
+}
+
+// addresses looks up host in the families the probe checks, IPv6 first.
+// A failed lookup of one family still returns the addresses of the other.
+func (p *SOAProbe) addresses(ctx context.Context, host string) ([]string, error) {
+	var types []uint16
+	if p.family != "ipv4" {
+		types = append(types, dns.TypeAAAA)
+	}
+	if p.family != "ipv6" {
+		types = append(types, dns.TypeA)
+	}
+	var addrs []string
+	var errs []error
+	for _, t := range types {
+		resp, err := p.lookup(ctx, host, t)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			}
+		}
+	}
+	return addrs, errors.Join(errs...)
+}
+
+// lookup asks the configured (recursive) resolver.
+func (p *SOAProbe) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	resp, _, err := p.client.ExchangeContext(ctx, msg, p.resolver)
+	if err == nil && resp.Truncated {
+		resp, _, err = p.tcpClient.ExchangeContext(ctx, msg, p.resolver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("looking up %s %s: %w", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("looking up %s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
@@ -0,0 +1,148 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// zoneServer is both the resolver and the authoritative server of
+// example.com in the tests, over udp and tcp on the same port: ns1 and ns2
+// have 127.0.0.1, the address lookup of broken fails and empty has no
+// address. www has two addresses behind a CNAME, nx does not exist and
+// big is truncated over udp.
+func zoneServer(t *testing.T) string {
+	t.Helper()
+	var conn net.PacketConn
+	var ln net.Listener
+	for attempt := 0; ln == nil; attempt++ {
+		var err error
+		if conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		// the tcp port may be taken
+		if ln, err = net.Listen("tcp", conn.LocalAddr().String()); err != nil {
+			conn.Close()
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		reply := new(dns.Msg)
+		reply.SetReply(r)
+		q := r.Question[0]
+		answer := func(s string) {
+			rr, _ := dns.NewRR(s)
+			reply.Answer = append(reply.Answer, rr)
+		}
+		switch {
+		case q.Name == "broken.example.com.":
+			reply.Rcode = dns.RcodeServerFailure
+		case q.Name == "nx.example.com.":
+			reply.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA && (q.Name == "ns1.example.com." || q.Name == "ns2.example.com."):
+			answer(q.Name + " 300 IN A 127.0.0.1")
+		case q.Qtype == dns.TypeA && q.Name == "www.example.com.":
+			answer("www.example.com. 600 IN CNAME web.example.com.")
+			answer("web.example.com. 300 IN A 192.0.2.1")
+			answer("web.example.com. 300 IN A 192.0.2.2")
+		case q.Qtype == dns.TypeA && q.Name == "big.example.com.":
+			if w.LocalAddr().Network() == "udp" {
+				reply.Truncated = true
+				break
+			}
+			answer("big.example.com. 300 IN A 192.0.2.3")
+		case q.Qtype == dns.TypeSOA && q.Name == "example.com.":
+			reply.Authoritative = true
+			answer("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 3600 600 86400 300")
+		}
+		w.WriteMsg(reply)
+	})
+	udp := &dns.Server{PacketConn: conn, Handler: handler}
+	tcp := &dns.Server{Listener: ln, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return conn.LocalAddr().String()
+}
+
+func TestSOAFailedLookup(t *testing.T) {
+	addr := zoneServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+
+	pr, err := NewSOA(plugin.ProbeConfig{
+		Name:     "test",
+		Type:     "soa",
+		Target:   "example.com",
+		Interval: time.Minute,
+		Timeout:  time.Second,
+		Family:   "ipv4",
+		Resolver: addr,
+		Nameservers: []string{
+			"ns1.example.com:" + port,
+			"broken.example.com:" + port,
+			"empty.example.com:" + port,
+			"127.0.0.1:" + port,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := pr.Run(context.Background())
+	if len(metrics) != 5 {
+		t.Fatalf("got %d metrics, want 4 servers and the summary", len(metrics))
+	}
+
+	ok := map[string]bool{}
+	for _, m := range metrics[:4] {
+		server := m.Tags[TagServer]
+		ok[server] = m.Status == plugin.StatusOK
+		if m.Status == plugin.StatusOK && m.Fields[FieldSerial] != 2024010101 {
+			t.Errorf("%s: serial %v", server, m.Fields[FieldSerial])
+		}
+		if m.Status != plugin.StatusOK && m.Tags[plugin.TagAddr] != "" {
+			t.Errorf("%s: failed lookup has addr %s", server, m.Tags[plugin.TagAddr])
+		}
+	}
+	want := map[string]bool{"ns1.example.com": true, "broken.example.com": false, "empty.example.com": false, "127.0.0.1": true}
+	for server, w := range want {
+		if got, found := ok[server]; !found || got != w {
+			t.Errorf("server %s: ok=%v (found %v), want ok=%v", server, got, found, w)
+		}
+	}
+
+	summary := metrics[4]
+	if summary.Status != plugin.StatusOK || summary.Fields[FieldServers] != 4 || summary.Fields[FieldAnswered] != 2 {
+		t.Errorf("summary status %s (%s), fields %v", summary.Status, summary.Error, summary.Fields)
+	}
+}
+
+func TestCompareSerials(t *testing.T) {
+	tests := []struct {
+		serials  []uint32
+		newest   uint32
+		lag      uint32
+		distinct int
+	}{
+		{[]uint32{5, 5, 5}, 5, 0, 1},
+		{[]uint32{3, 5, 4}, 5, 2, 3},
+		// RFC 1982: 1 is newer than 4294967295
+		{[]uint32{4294967295, 1}, 1, 2, 2},
+	}
+	for _, tt := range tests {
+		newest, lag, distinct := compareSerials(tt.serials)
+		if newest != tt.newest || lag != tt.lag || distinct != tt.distinct {
+			t.Errorf("compareSerials(%v) = %d, %d, %d, want %d, %d, %d",
+				tt.serials, newest, lag, distinct, tt.newest, tt.lag, tt.distinct)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Only this much of stdout is parsed; a check that prints more is broken.
+const maxOutput = 1 << 20
+
+// How long to wait for the output after the command exited or was killed,
+// in case something it started still holds stdout or stderr open.
+const waitDelay = time.Second
+
+// Fields added by the exec probe to every metric of a run.
+const (
+	FieldValue    = "value"     // the number printed with format number
+	FieldDuration = "duration"  // run time of the command, ms
+	FieldExitCode = "exit_code" // -1 if it was killed
+)
+
+// Output formats.
+const (
+	FormatNumber = "number"
+	FormatJSON   = "json"
+	FormatInflux = "influx"
+)
+
+// ExecProbe runs a command and turns what it prints into metrics. The
+// command is run directly, not through a shell, with the probe's name and
+// target in TOKEPING_PROBE and TOKEPING_TARGET, in a process group of its
+// own that is killed when the run ends.
+type ExecProbe struct {
+	name     string
+	target   string
+	interval time.Duration
+	timeout  time.Duration
+	command  []string
+	format   string
+	log      *logging.Logger
+}
+
+func init() {
+	plugin.RegisterProbe("exec", New)
+	plugin.RegisterProbeValidator("exec", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+	if len(cfg.Command) == 0 || cfg.Command[0] == "" {
+		return errors.New("exec probe needs a command")
+	}
+	switch cfg.Format {
+	case "", FormatNumber, FormatJSON, FormatInflux:
+	default:
+		return fmt.Errorf("unknown format %q (want number, json or influx)", cfg.Format)
+	}
+	return nil
+}
+
+func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	format := cfg.Format
+	if format == "" {
+		format = FormatNumber
+	}
+	return &ExecProbe{
+		name:     cfg.Name,
+		target:   cfg.Target,
+		interval: cfg.Interval,
+		timeout:  timeout,
+		command:  cfg.Command,
+		format:   format,
+		log:      plugin.ProbeLogger(cfg),
+	}, nil
+}
+
+func (p *ExecProbe) Name() string            { return p.name }
+func (p *ExecProbe) Interval() time.Duration { return p.interval }
+
+func (p *ExecProbe) Run(ctx context.Context) []plugin.Metric {
+	return p.exec(ctx)
+}
+
+// exec runs the command once and returns the metrics parsed from its
+// output. A non-zero exit fails the run, but whatever the command printed
+// is still parsed, so a failing check can report why in its fields.
+func (p *ExecProbe) exec(ctx context.Context) []plugin.Metric {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Env = append(os.Environ(), "TOKEPING_PROBE="+p.name, "TOKEPING_TARGET="+p.target)
+	cmd.Stdout = &limitWriter{&stdout, maxOutput}
+	cmd.Stderr = &limitWriter{&stderr, maxOutput}
+	// the command gets its own process group, so that on a timeout the
+	// children it started, such as a shell's background jobs, are killed
+	// with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+
+	start := time.Now()
+	runErr := cmd.Run()
+	elapsed := time.Since(start)
+	if cmd.Process != nil {
+		// whatever it left running is not ours to keep
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if errors.Is(runErr, exec.ErrWaitDelay) && cmd.ProcessState.Success() {
+		// the command itself finished; a child held the output open
+		runErr = nil
+	}
+	p.log.Debug("command done", "took", elapsed, "exit_code", cmd.ProcessState.ExitCode(),
+		"stdout", stdout.String(), "stderr", stderr.String())
+	if ctx.Err() == context.DeadlineExceeded {
+		runErr = fmt.Errorf("command timed out after %s: %w", p.timeout, ctx.Err())
+	} else if runErr != nil && stderr.Len() > 0 {
+		runErr = fmt.Errorf("%v: %s", runErr, firstLine(stderr.String()))
+	}
+
+	metrics, parseErr := p.parse(stdout.Bytes())
+	if parseErr != nil || len(metrics) == 0 {
+		metrics = []plugin.Metric{p.newMetric()}
+	}
+	for i := range metrics {
+		m := &metrics[i]
+		m.Fields[FieldDuration] = elapsed.Seconds() * 1000
+		m.Fields[FieldExitCode] = float64(cmd.ProcessState.ExitCode())
+		switch {
+		case runErr != nil:
+			m.Tags[plugin.TagFailure] = plugin.ClassifyError(runErr)
+			m.Fail(runErr)
+		case parseErr != nil:
+			m.Tags[plugin.TagFailure] = plugin.FailureUnexpected
+			m.Fail(parseErr)
+		}
+	}
+	if err := metrics[0].Error; err != "" {
+		p.log.Warn("command failed", "command", p.command[0], "err", err)
+	}
+	return metrics
+}
+
+func (p *ExecProbe) newMetric() plugin.Metric {
+	m := plugin.NewMetric(p.name, "exec")
+	if p.target != "" {
+		m.Tags[plugin.TagTarget] = p.target
+	}
+	return m
+}
+
+// parse turns the command output into metrics according to the format.
+func (p *ExecProbe) parse(out []byte) ([]plugin.Metric, error) {
+	switch p.format {
+	case FormatJSON:
+		return p.parseJSON(out)
+	case FormatInflux:
+		return p.parseInflux(out)
+	}
+	m := p.newMetric()
+	v, err := parseNumber(string(out))
+	if err != nil {
+		return nil, err
+	}
+	m.Fields[FieldValue] = v
+	return []plugin.Metric{m}, nil
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// limitWriter keeps the first n bytes written to it and discards the rest,
+// so a runaway command cannot fill the memory.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if l.n > 0 {
+		keep := b
+		if int64(len(keep)) > l.n {
+			keep = keep[:l.n]
+		}
+		n, err := l.w.Write(keep)
+		l.n -= int64(n)
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,112 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+)
+
+func newProbe(t *testing.T, cfg plugin.ProbeConfig) *ExecProbe {
+	t.Helper()
+	cfg.Name, cfg.Type, cfg.Interval = "test", "exec", time.Minute
+	if err := validate(cfg); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	pr, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return pr.(*ExecProbe)
+}
+
+// running reports whether pid is a live process; zombies waiting for a
+// parent that does not reap them count as gone.
+func running(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// the state follows the command name in parentheses
+	s := string(stat)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		ok      bool
+		value   float64
+		exit    float64
+		failure string
+	}{
+		{"number", []string{"echo", "42.5"}, true, 42.5, 0, ""},
+		{"environment", []string{"sh", "-c", `test "$TOKEPING_PROBE" = test && echo 1`}, true, 1, 0, ""},
+		{"exit code", []string{"sh", "-c", "echo 3; exit 2"}, false, 3, 2, plugin.FailureOther},
+		{"not a number", []string{"echo", "up"}, false, 0, 0, plugin.FailureUnexpected},
+		{"missing", []string{"/nonexistent/check"}, false, 0, -1, plugin.FailureOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newProbe(t, plugin.ProbeConfig{Command: tt.command}).Run(context.Background())[0]
+			if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+				t.Errorf("status %s (%s), want ok=%v", m.Status, m.Error, tt.ok)
+			}
+			if m.Fields[FieldValue] != tt.value || m.Fields[FieldExitCode] != tt.exit {
+				t.Errorf("fields %v, want value %v, exit code %v", m.Fields, tt.value, tt.exit)
+			}
+			if m.Tags[plugin.TagFailure] != tt.failure {
+				t.Errorf("failure %q, want %q", m.Tags[plugin.TagFailure], tt.failure)
+			}
+		})
+	}
+}
+
+// A shell's background job holds stdout open and would outlive the run:
+// the probe must neither wait for it nor leave it running. The command
+// prints the job's PID as its value.
+func TestChildren(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		ok      bool
+	}{
+		{"timeout", "sleep 30 & echo $!; wait", 200 * time.Millisecond, false},
+		{"left behind", "sleep 30 & echo $!", 10 * time.Second, true},
+		{"left behind detached", "sleep 30 >/dev/null 2>&1 & echo $!", 10 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newProbe(t, plugin.ProbeConfig{Command: []string{"sh", "-c", tt.command}, Timeout: tt.timeout})
+			start := time.Now()
+			m := p.Run(context.Background())[0]
+			if took := time.Since(start); took > tt.timeout+waitDelay+time.Second {
+				t.Errorf("run took %s", took)
+			}
+			if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+				t.Errorf("status %s (%s), want ok=%v", m.Status, m.Error, tt.ok)
+			}
+			if !tt.ok && m.Tags[plugin.TagFailure] != plugin.FailureTimeout {
+				t.Errorf("failure %q, want %q", m.Tags[plugin.TagFailure], plugin.FailureTimeout)
+			}
+			pid := int(m.Fields[FieldValue])
+			if pid <= 0 {
+				t.Fatalf("no PID in %v", m.Fields)
+			}
+			deadline := time.Now().Add(time.Second)
+			for running(pid) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if running(pid) {
+				t.Errorf("background job %d still running", pid)
+			}
+		})
+	}
+}
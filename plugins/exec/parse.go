@@ -0,0 +1,217 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tokeping/pkg/plugin"
+)
+
+// TagMeasurement carries the measurement name of influx line protocol
+// output; the metric type stays "exec".
+const TagMeasurement = "measurement"
+
+func parseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("command printed nothing")
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("output is not a number: %q", firstLine(s))
+	}
+	return v, nil
+}
+
+// parseJSON reads an object, or an array of objects for several metrics.
+// Numbers and booleans become fields, strings become tags.
+func (p *ExecProbe) parseJSON(out []byte) ([]plugin.Metric, error) {
+	out = bytes.TrimSpace(out)
+	var objects []map[string]interface{}
+	if len(out) > 0 && out[0] == '[' {
+		if err := json.Unmarshal(out, &objects); err != nil {
+			return nil, fmt.Errorf("parsing JSON output: %w", err)
+		}
+	} else {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(out, &obj); err != nil {
+			return nil, fmt.Errorf("parsing JSON output: %w", err)
+		}
+		objects = append(objects, obj)
+	}
+
+	var metrics []plugin.Metric
+	for _, obj := range objects {
+		m := p.newMetric()
+		for k, v := range obj {
+			switch v := v.(type) {
+			case float64:
+				m.Fields[k] = v
+			case bool:
+				m.Fields[k] = boolValue(v)
+			case string:
+				m.Tags[k] = v
+			case nil:
+			default:
+				return nil, fmt.Errorf("JSON key %q: nested values are not supported", k)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// parseInflux reads InfluxDB line protocol, one metric per line:
+//
+//	measurement,tag=value,... field=value,... [timestamp]
+//
+// Integer, unsigned and float fields are stored as numbers and booleans as
+// 1 or 0. String fields become tags, since metric fields are numbers. The
+// timestamp is in nanoseconds; without one the metric gets the current time.
+func (p *ExecProbe) parseInflux(out []byte) ([]plugin.Metric, error) {
+	var metrics []plugin.Metric
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 64*1024), maxOutput)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := p.newMetric()
+		if err := parseLine(line, &m); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		metrics = append(metrics, m)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+func parseLine(line string, m *plugin.Metric) error {
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return fmt.Errorf("want measurement, fields and an optional timestamp")
+	}
+
+	key := split(sections[0], ',', false)
+	if key[0] == "" {
+		return fmt.Errorf("missing measurement")
+	}
+	m.Tags[TagMeasurement] = unescape(key[0])
+	for _, kv := range key[1:] {
+		k, v, err := pair(kv, false)
+		if err != nil {
+			return err
+		}
+		m.Tags[k] = unescape(v)
+	}
+
+	for _, kv := range split(sections[1], ',', true) {
+		k, raw, err := pair(kv, true)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(raw, `"`) {
+			if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+				return fmt.Errorf("field %q: unterminated string", k)
+			}
+			m.Tags[k] = unescape(raw[1 : len(raw)-1])
+			continue
+		}
+		v, err := fieldValue(raw)
+		if err != nil {
+			return fmt.Errorf("field %q: %w", k, err)
+		}
+		m.Fields[k] = v
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		m.Time = ts
+	}
+	return nil
+}
+
+// fieldValue parses an unquoted field value. Strings are handled by the
+// caller. Integers and unsigned integers carry an i or u suffix.
+func fieldValue(raw string) (float64, error) {
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, nil
+	}
+	switch {
+	case strings.HasSuffix(raw, "i"):
+		v, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		return float64(v), err
+	case strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseUint(strings.TrimSuffix(raw, "u"), 10, 64)
+		return float64(v), err
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// pair splits key=value, unescaping the key only. quotes is set for
+// fields, whose string values may contain a quoted =.
+func pair(kv string, quotes bool) (string, string, error) {
+	parts := split(kv, '=', quotes)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid key=value %q", kv)
+	}
+	return unescape(parts[0]), parts[1], nil
+}
+
+// split splits s at every sep that is not escaped with a backslash and,
+// with quotes, not inside a double-quoted string. Escapes are kept, and
+// multiple spaces count as one separator.
+func split(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			if sep != ' ' || i > start {
+				parts = append(parts, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescape drops the backslashes of escaped characters. Quoted string
+// field values are unescaped by the caller after the quotes are removed.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
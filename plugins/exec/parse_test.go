@@ -0,0 +1,147 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+
+	"tokeping/pkg/plugin"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		out  string
+		want float64
+		ok   bool
+	}{
+		{"42\n", 42, true},
+		{"  -1.5e3 ", -1500, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"\n", 0, false},
+		{"12 ms", 0, false},
+		{"1\n2\n", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseNumber(tt.out)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseNumber(%q) = %v, %v, want %v, ok=%v", tt.out, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// metric is what the parsers produce, without the time.
+type metric struct {
+	Fields map[string]float64
+	Tags   map[string]string
+}
+
+func metrics(ms []plugin.Metric) []metric {
+	var out []metric
+	for _, m := range ms {
+		out = append(out, metric{m.Fields, m.Tags})
+	}
+	return out
+}
+
+func TestParseJSON(t *testing.T) {
+	p := &ExecProbe{name: "test", target: "db1"}
+	tests := []struct {
+		name string
+		out  string
+		want []metric
+		ok   bool
+	}{
+		{
+			name: "object",
+			out:  `{"rtt": 12.5, "up": true, "role": "primary", "note": null}`,
+			want: []metric{{map[string]float64{"rtt": 12.5, "up": 1}, map[string]string{"role": "primary", plugin.TagTarget: "db1"}}},
+			ok:   true,
+		},
+		{
+			name: "array",
+			out:  "[{\"lag\": 0}, {\"lag\": 3, \"replica\": \"b\"}]\n",
+			want: []metric{
+				{map[string]float64{"lag": 0}, map[string]string{plugin.TagTarget: "db1"}},
+				{map[string]float64{"lag": 3}, map[string]string{"replica": "b", plugin.TagTarget: "db1"}},
+			},
+			ok: true,
+		},
+		{name: "nested", out: `{"a": {"b": 1}}`},
+		{name: "list value", out: `{"a": [1, 2]}`},
+		{name: "not an object", out: `42`},
+		{name: "broken", out: `{"a": 1`},
+		{name: "empty", out: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.parseJSON([]byte(tt.out))
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok=%v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(metrics(got), tt.want) {
+				t.Errorf("got  %+v\nwant %+v", metrics(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInflux(t *testing.T) {
+	p := &ExecProbe{name: "test"}
+	tests := []struct {
+		name string
+		out  string
+		want []metric
+		time int64 // of the first metric, 0 for the current time
+		ok   bool
+	}{
+		{
+			name: "types",
+			out:  `disk,mount=/var used=12.5,inodes=3i,big=7u,ro=false,ok=T`,
+			want: []metric{{
+				map[string]float64{"used": 12.5, "inodes": 3, "big": 7, "ro": 0, "ok": 1},
+				map[string]string{TagMeasurement: "disk", "mount": "/var"},
+			}},
+			ok: true,
+		},
+		{
+			name: "timestamp and several lines",
+			out:  "# comment\nq depth=1 1700000000000000000\n\nq depth=2\n",
+			want: []metric{
+				{map[string]float64{"depth": 1}, map[string]string{TagMeasurement: "q"}},
+				{map[string]float64{"depth": 2}, map[string]string{TagMeasurement: "q"}},
+			},
+			time: 1700000000000000000,
+			ok:   true,
+		},
+		{
+			name: "escapes and strings",
+			out:  `my\ app,host=a\,b,path=C:\\x msg="say \"hi\", ok",n=1`,
+			want: []metric{{
+				map[string]float64{"n": 1},
+				map[string]string{TagMeasurement: "my app", "host": "a,b", "path": `C:\x`, "msg": `say "hi", ok`},
+			}},
+			ok: true,
+		},
+		{name: "no fields", out: "disk"},
+		{name: "no measurement", out: ",a=b f=1"},
+		{name: "bad field", out: "disk used=lots"},
+		{name: "bad integer", out: "disk used=1.5i"},
+		{name: "unterminated string", out: `disk msg="oops`},
+		{name: "bad timestamp", out: "disk used=1 yesterday"},
+		{name: "empty key", out: "disk =1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.parseInflux([]byte(tt.out))
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok=%v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(metrics(got), tt.want) {
+				t.Errorf("got  %+v\nwant %+v", metrics(got), tt.want)
+			}
+			if tt.time != 0 && got[0].Time != tt.time {
+				t.Errorf("time %d, want %d", got[0].Time, tt.time)
+			}
+		})
+	}
+}
@@ -1,7 +1,8 @@
 package file
 
 import (
-    "fmt"
+    "encoding/json"
+    "errors"
     "os"
     "sync"
 
@@ -16,6 +17,12 @@ type FileOutput struct {
 
 func init() {
     plugin.RegisterOutput("file", New)
+    plugin.RegisterOutputValidator("file", func(cfg plugin.OutputConfig) error {
+        if cfg.Path == "" {
+            return errors.New("file output needs a path")
+        }
+        return nil
+    })
 }
 
 func New(cfg plugin.OutputConfig) (plugin.Output, error) {
@@ -31,8 +38,12 @@ func (o *FileOutput) Start() error { return nil }
 func (o *FileOutput) Send(m plugin.Metric) {
     o.mu.Lock()
     defer o.mu.Unlock()
-    line := fmt.Sprintf("%d,%s,%.3f", m.Time, m.Probe, m.Latency)
-    o.file.WriteString(line)
+    // one JSON object per line
+    b, err := json.Marshal(m)
+    if err != nil {
+        return
+    }
+    o.file.Write(append(b, '\n'))
 }
 func (o *FileOutput) Stop() error {
     return o.file.Close()
@@ -0,0 +1,291 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Only this much of the body is kept for expect_body/expect_regex matching;
+// the rest is read and counted but discarded.
+const maxMatchBody = 1 << 20
+
+// HTTPProbe fetches a URL and reports the time spent in each phase of the
+// request: DNS lookup, TCP connect, TLS handshake, time to first byte and
+// total transfer time.
+type HTTPProbe struct {
+	name         string
+	target       string
+	interval     time.Duration
+	timeout      time.Duration
+	method       string
+	headers      map[string]string
+	httpVersion  string
+	expectStatus []int
+	expectBody   string
+	expectRegex  *regexp.Regexp
+	ipv6         bool
+	client       *http.Client
+	log          *logging.Logger
+}
+
+func init() {
+	plugin.RegisterProbe("http", New)
+	plugin.RegisterProbeValidator("http", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+	u, err := url.Parse(cfg.Target)
+	if err != nil {
+		return fmt.Errorf("invalid http target: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("http target must be an http:// or https:// URL")
+	}
+	switch cfg.HTTPVersion {
+	case "", "1.1":
+	case "2":
+		if u.Scheme != "https" {
+			return fmt.Errorf("http_version 2 requires an https:// target")
+		}
+	default:
+		return fmt.Errorf("unknown http_version %q (want 1.1 or 2)", cfg.HTTPVersion)
+	}
+	if _, err := regexp.Compile(cfg.ExpectRegex); err != nil {
+		return fmt.Errorf("invalid expect_regex: %v", err)
+	}
+	return nil
+}
+
+func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	if err := validate(cfg); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(cfg.Target)
+	ipv6, err := plugin.PreferIPv6(u.Hostname(), cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	hp := &HTTPProbe{
+		name:         cfg.Name,
+		target:       cfg.Target,
+		interval:     cfg.Interval,
+		timeout:      cfg.Timeout,
+		method:       strings.ToUpper(cfg.Method),
+		headers:      cfg.Headers,
+		httpVersion:  cfg.HTTPVersion,
+		expectStatus: cfg.ExpectStatus,
+		expectBody:   cfg.ExpectBody,
+		ipv6:         ipv6,
+		log:          plugin.ProbeLogger(cfg),
+	}
+	if hp.timeout <= 0 {
+		hp.timeout = defaultTimeout
+	}
+	if hp.method == "" {
+		hp.method = http.MethodGet
+	}
+	if cfg.ExpectRegex != "" {
+		hp.expectRegex = regexp.MustCompile(cfg.ExpectRegex)
+	}
+
+	network := "tcp4"
+	if ipv6 {
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		// a fresh connection every run, so every phase is measured
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{},
+	}
+	switch cfg.HTTPVersion {
+	case "":
+		transport.ForceAttemptHTTP2 = true
+	case "1.1":
+		// a non-nil, empty map disables HTTP/2 negotiation
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case "2":
+		transport.ForceAttemptHTTP2 = true
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+	hp.client = &http.Client{
+		Transport: transport,
+		// report redirects as they are instead of following them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return hp, nil
+}
+
+func (p *HTTPProbe) Name() string            { return p.name }
+func (p *HTTPProbe) Interval() time.Duration { return p.interval }
+
+func (p *HTTPProbe) Run(ctx context.Context) []plugin.Metric {
+	m := p.fetch(ctx)
+	if m.Error != "" {
+		p.log.Warn("request failed", "target", p.target, "err", m.Error)
+	}
+	return []plugin.Metric{m}
+}
+
+// phases records the timestamps reported by httptrace for one request.
+type phases struct {
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+}
+
+func (ph *phases) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { ph.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { ph.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { ph.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { ph.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { ph.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { ph.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { ph.firstByte = time.Now() },
+	}
+}
+
+func ms(from, to time.Time) float64 {
+	return to.Sub(from).Seconds() * 1000
+}
+
+func (p *HTTPProbe) fetch(ctx context.Context) plugin.Metric {
+	m := plugin.NewMetric(p.name, "http")
+	m.Tags[plugin.TagTarget] = p.target
+	m.Tags[plugin.TagFamily] = plugin.Family(p.ipv6)
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var ph phases
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, ph.trace()), p.method, p.target, nil)
+	if err != nil {
+		m.Fail(err)
+		return m
+	}
+	for k, v := range p.headers {
+		if strings.EqualFold(k, "Host") {
+			// net/http ignores a Host header, the virtual host goes here
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+	defer resp.Body.Close()
+
+	var body bytes.Buffer
+	size, err := io.Copy(&limitWriter{&body, maxMatchBody}, resp.Body)
+	end := time.Now()
+
+	m.Tags[plugin.TagProtocol] = resp.Proto
+	m.Fields["status"] = float64(resp.StatusCode)
+	m.Fields["size"] = float64(size)
+	if !ph.dnsDone.IsZero() {
+		m.Fields["dns"] = ms(ph.dnsStart, ph.dnsDone)
+	}
+	if !ph.connectDone.IsZero() {
+		m.Fields["connect"] = ms(ph.connectStart, ph.connectDone)
+	}
+	if !ph.tlsDone.IsZero() {
+		m.Fields["tls"] = ms(ph.tlsStart, ph.tlsDone)
+	}
+	if !ph.firstByte.IsZero() {
+		m.Fields["ttfb"] = ms(start, ph.firstByte)
+	}
+	m.Fields["total"] = ms(start, end)
+	m.Fields[plugin.FieldRTT] = m.Fields["total"]
+	if p.log.Enabled(logging.LevelDebug) {
+		p.log.Debug("got response", "proto", resp.Proto, "status", resp.StatusCode, "size", size,
+			"headers", fmt.Sprint(resp.Header))
+	}
+
+	if err != nil {
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(fmt.Errorf("reading body: %v", err))
+		return m
+	}
+	if p.httpVersion == "2" && resp.ProtoMajor != 2 {
+		// Go falls back to HTTP/1.1 if the server doesn't offer h2
+		m.Tags[plugin.TagFailure] = plugin.FailureUnexpected
+		m.Fail(fmt.Errorf("server did not negotiate HTTP/2, got %s", resp.Proto))
+		return m
+	}
+	if err := p.check(resp.StatusCode, body.Bytes()); err != nil {
+		m.Tags[plugin.TagFailure] = plugin.FailureUnexpected
+		m.Fail(err)
+	}
+	return m
+}
+
+// check applies the configured expectations to a response.
+func (p *HTTPProbe) check(status int, body []byte) error {
+	if len(p.expectStatus) > 0 {
+		ok := false
+		for _, s := range p.expectStatus {
+			if s == status {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unexpected status %d", status)
+		}
+	} else if status >= 400 {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	if p.expectBody != "" && !bytes.Contains(body, []byte(p.expectBody)) {
+		return fmt.Errorf("body does not contain %q", p.expectBody)
+	}
+	if p.expectRegex != nil && !p.expectRegex.Match(body) {
+		return fmt.Errorf("body does not match %q", p.expectRegex)
+	}
+	return nil
+}
+
+// limitWriter keeps the first n bytes written and silently drops the rest.
+type limitWriter struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if room := w.n - w.buf.Len(); room > 0 {
+		if len(b) > room {
+			w.buf.Write(b[:room])
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
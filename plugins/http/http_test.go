@@ -0,0 +1,184 @@
+package http
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+)
+
+func testServer() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/host", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	})
+	mux.HandleFunc("/proto", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	return mux
+}
+
+// run creates a probe for cfg and runs it once. Servers started with TLS
+// are trusted by the probe.
+func run(t *testing.T, srv *httptest.Server, cfg plugin.ProbeConfig) plugin.Metric {
+	t.Helper()
+	cfg.Name, cfg.Type, cfg.Interval = "test", "http", time.Minute
+	cfg.Target = srv.URL + cfg.Target
+	pr, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if srv.TLS != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(srv.Certificate())
+		pr.(*HTTPProbe).client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	}
+	metrics := pr.Run(context.Background())
+	if len(metrics) != 1 {
+		t.Fatalf("got %d metrics, want 1", len(metrics))
+	}
+	return metrics[0]
+}
+
+func TestChecks(t *testing.T) {
+	srv := httptest.NewServer(testServer())
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		cfg    plugin.ProbeConfig
+		ok     bool
+		status float64
+	}{
+		{"ok", plugin.ProbeConfig{Target: "/ok"}, true, 200},
+		{"not found", plugin.ProbeConfig{Target: "/missing"}, false, 404},
+		{"expected 404", plugin.ProbeConfig{Target: "/missing", ExpectStatus: []int{404}}, true, 404},
+		{"unexpected 200", plugin.ProbeConfig{Target: "/ok", ExpectStatus: []int{204}}, false, 200},
+		{"body", plugin.ProbeConfig{Target: "/ok", ExpectBody: "world"}, true, 200},
+		{"body missing", plugin.ProbeConfig{Target: "/ok", ExpectBody: "nope"}, false, 200},
+		{"regex", plugin.ProbeConfig{Target: "/ok", ExpectRegex: "^hel+o"}, true, 200},
+		{"regex mismatch", plugin.ProbeConfig{Target: "/ok", ExpectRegex: "^world"}, false, 200},
+		{"redirect not followed", plugin.ProbeConfig{Target: "/redirect"}, true, 302},
+		{"redirect unexpected", plugin.ProbeConfig{Target: "/redirect", ExpectStatus: []int{200}}, false, 302},
+		{"virtual host", plugin.ProbeConfig{Target: "/host", Headers: map[string]string{"Host": "vhost.example"}, ExpectBody: "vhost.example"}, true, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := run(t, srv, tt.cfg)
+			if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+				t.Errorf("status %s (%s), want ok=%v", m.Status, m.Error, tt.ok)
+			}
+			if m.Fields["status"] != tt.status {
+				t.Errorf("status field %v, want %v", m.Fields["status"], tt.status)
+			}
+			if !tt.ok && m.Tags[plugin.TagFailure] != plugin.FailureUnexpected {
+				t.Errorf("failure tag %q, want %q", m.Tags[plugin.TagFailure], plugin.FailureUnexpected)
+			}
+		})
+	}
+}
+
+func TestPhases(t *testing.T) {
+	plain := httptest.NewServer(testServer())
+	defer plain.Close()
+	secure := httptest.NewTLSServer(testServer())
+	defer secure.Close()
+
+	tests := []struct {
+		name   string
+		srv    *httptest.Server
+		fields []string
+		absent []string
+	}{
+		// IP literal targets, so no DNS phase
+		{"http", plain, []string{"connect", "ttfb", "total", "rtt", "size"}, []string{"dns", "tls"}},
+		{"https", secure, []string{"connect", "tls", "ttfb", "total", "rtt", "size"}, []string{"dns"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := run(t, tt.srv, plugin.ProbeConfig{Target: "/ok"})
+			if m.Status != plugin.StatusOK {
+				t.Fatalf("run failed: %s", m.Error)
+			}
+			for _, f := range tt.fields {
+				if v, ok := m.Fields[f]; !ok || v < 0 {
+					t.Errorf("field %s = %v, %v", f, v, ok)
+				}
+			}
+			for _, f := range tt.absent {
+				if _, ok := m.Fields[f]; ok {
+					t.Errorf("unexpected field %s", f)
+				}
+			}
+			if m.Fields["ttfb"] > m.Fields["total"] {
+				t.Errorf("ttfb %v after total %v", m.Fields["ttfb"], m.Fields["total"])
+			}
+		})
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	h1 := httptest.NewTLSServer(testServer())
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(testServer())
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	tests := []struct {
+		name    string
+		srv     *httptest.Server
+		version string
+		ok      bool
+		proto   string
+	}{
+		{"negotiated h2", h2, "", true, "HTTP/2.0"},
+		{"forced 1.1", h2, "1.1", true, "HTTP/1.1"},
+		{"required h2", h2, "2", true, "HTTP/2.0"},
+		{"required h2 without server support", h1, "2", false, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := run(t, tt.srv, plugin.ProbeConfig{Target: "/proto", HTTPVersion: tt.version})
+			if ok := m.Status == plugin.StatusOK; ok != tt.ok {
+				t.Errorf("status %s (%s), want ok=%v", m.Status, m.Error, tt.ok)
+			}
+			if m.Tags[plugin.TagProtocol] != tt.proto {
+				t.Errorf("protocol %q, want %q", m.Tags[plugin.TagProtocol], tt.proto)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		cfg plugin.ProbeConfig
+		ok  bool
+	}{
+		{plugin.ProbeConfig{Target: "https://example.com/"}, true},
+		{plugin.ProbeConfig{Target: "ftp://example.com/"}, false},
+		{plugin.ProbeConfig{Target: "http://example.com/", HTTPVersion: "2"}, false},
+		{plugin.ProbeConfig{Target: "https://example.com/", HTTPVersion: "2"}, true},
+		{plugin.ProbeConfig{Target: "https://example.com/", HTTPVersion: "3"}, false},
+		{plugin.ProbeConfig{Target: "https://example.com/", ExpectRegex: "("}, false},
+	}
+	for _, tt := range tests {
+		if err := validate(tt.cfg); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok=%v", tt.cfg, err, tt.ok)
+		}
+	}
+}
@@ -3,9 +3,8 @@ package influxdb
 import (
 	"context"
 	"fmt"
-	"os"
-	"time"
 
+	"tokeping/pkg/logging"
 	"tokeping/pkg/plugin"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -15,30 +14,57 @@ import (
 type InfluxOutput struct {
 	client   influxdb2.Client
 	writeAPI api.WriteAPIBlocking
+	log      *logging.Logger
 }
 
 func init() {
 	plugin.RegisterOutput("influxdb", New)
+	plugin.RegisterOutputValidator("influxdb", func(cfg plugin.OutputConfig) error {
+		if cfg.URL == "" || cfg.Org == "" || cfg.Bucket == "" {
+			return fmt.Errorf("influxdb output needs url, org and bucket")
+		}
+		return nil
+	})
 }
 
 func New(cfg plugin.OutputConfig) (plugin.Output, error) {
 	client := influxdb2.NewClient(cfg.URL, cfg.Token)
 	writeAPI := client.WriteAPIBlocking(cfg.Org, cfg.Bucket)
-	return &InfluxOutput{client: client, writeAPI: writeAPI}, nil
+	log := logging.New("influxdb").With("output", cfg.Name)
+	return &InfluxOutput{client: client, writeAPI: writeAPI, log: log}, nil
 }
 
 func (o *InfluxOutput) Name() string { return "influxdb" }
 func (o *InfluxOutput) Start() error { return nil }
 func (o *InfluxOutput) Send(m plugin.Metric) {
+	// events go to their own measurement, for use as graph annotations
+	measurement := "latency"
+	if m.Tags[plugin.TagEvent] != "" {
+		measurement = "events"
+	}
+
 	// build the point
-	point := influxdb2.NewPointWithMeasurement("latency").
+	point := influxdb2.NewPointWithMeasurement(measurement).
 		AddTag("probe", m.Probe).
-		AddField("value", m.Latency).
-		SetTime(time.Unix(m.Time, 0))
+		AddTag("type", m.Type).
+		AddTag("status", string(m.Status)).
+		SetTime(m.Timestamp())
+	for k, v := range m.Tags {
+		point.AddTag(k, v)
+	}
+	for k, v := range m.Fields {
+		point.AddField(k, v)
+	}
+	for k, v := range m.Text {
+		point.AddField(k, v)
+	}
+	if m.Error != "" {
+		point.AddField("error", m.Error)
+	}
 
 	// write it, logging any error
 	if err := o.writeAPI.WritePoint(context.Background(), point); err != nil {
-		fmt.Fprintf(os.Stderr, "❌ influx write error: %v\n", err)
+		o.log.Warn("write failed", "probe", m.Probe, "err", err)
 	}
 }
 
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package mtr
+
+import (
+	"errors"
+	"syscall"
+)
+
+func ttlControl(int, bool, func(int)) func(string, string, syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error {
+		return errors.New("tcp traces are not supported on this platform")
+	}
+}
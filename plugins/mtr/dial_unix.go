@@ -0,0 +1,44 @@
+//go:build unix
+
+package mtr
+
+import "syscall"
+
+// ttlControl sets the TTL of a dialer's socket and binds it, so bound is
+// told the source port before the SYN goes out.
+func ttlControl(ttl int, v6 bool, bound func(port int)) func(string, string, syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			s := int(fd)
+			if v6 {
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+				if err == nil {
+					err = syscall.Bind(s, &syscall.SockaddrInet6{})
+				}
+			} else {
+				err = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+				if err == nil {
+					err = syscall.Bind(s, &syscall.SockaddrInet4{})
+				}
+			}
+			if err != nil {
+				return
+			}
+			var sa syscall.Sockaddr
+			if sa, err = syscall.Getsockname(s); err != nil {
+				return
+			}
+			switch sa := sa.(type) {
+			case *syscall.SockaddrInet4:
+				bound(sa.Port)
+			case *syscall.SockaddrInet6:
+				bound(sa.Port)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -1,80 +1,125 @@
 package mtr
 
 import (
-	"bufio"
 	"context"
 	"fmt"
+	"math"
 	"net"
-	"os"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"tokeping/pkg/logging"
 	"tokeping/pkg/plugin"
 )
 
-// MTRProbe performs traceroute-like latency measurements using the mtr binary.
-// Emits one metric per hop as "{probeName}_{hopHost}" with average latency in ms.
+const (
+	defaultRounds  = 5
+	defaultMaxHops = 30
+	defaultTimeout = 2 * time.Second
+	defaultTCPPort = 80
 
+	// How long to wait for a reverse DNS answer for a hop.
+	lookupTimeout = time.Second
+)
+
+// Responder tag for a hop where nothing answered, as mtr shows it.
+const silentHop = "???"
+
+// TagHostname carries the reverse DNS name of a hop's responder.
+const TagHostname = "hostname"
+
+// MTRProbe traces the path to the target with TTL-limited icmp, udp or tcp
+// probes. Emits one metric per hop and responder, tagged with the hop
+// index, responder address and its reverse DNS name, carrying the hop's
+// loss and the responder's min/avg/max/stddev latency in ms, plus a path
+// change event when the route differs from the previous trace.
 type MTRProbe struct {
 	name     string
 	target   string
 	interval time.Duration
-	count    int
+	proto    string
+	port     int
+	rounds   int
+	maxHops  int
+	timeout  time.Duration
 	ipv6     bool
-	mtrPath  string
+
+	names map[string]string // reverse DNS cache, "" if the lookup failed
+	path  path              // of the last successful trace
+	log   *logging.Logger
 }
 
 func init() {
 	plugin.RegisterProbe("mtr", New)
+	plugin.RegisterProbeValidator("mtr", validate)
 }
 
-// New creates a new MTRProbe. It defaults to IPv6, falling back to IPv4 if no IPv6 addresses are found.
-func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
-	// Default to IPv6
-	ipv6 := true
-	// Check if target is a literal IP
-	if ip := net.ParseIP(cfg.Target); ip != nil {
-		if ip.To4() != nil {
-			ipv6 = false
-		}
-	} else {
-		// Domain name: lookup addresses
-		addrs, err := net.LookupIP(cfg.Target)
-		if err == nil {
-			has6, has4 := false, false
-			for _, addr := range addrs {
-				if addr.To4() != nil {
-					has4 = true
-				} else {
-					has6 = true
-				}
-			}
-			if has6 {
-				ipv6 = true
-			} else if has4 {
-				ipv6 = false
-			}
-		}
+func validate(cfg plugin.ProbeConfig) error {
+	switch cfg.Protocol {
+	case "", "icmp", "udp", "tcp":
+	default:
+		return fmt.Errorf("unknown mtr protocol %q (want icmp, udp or tcp)", cfg.Protocol)
 	}
-
-	// Locate mtr binary
-	mtrExe, err := exec.LookPath("mtr")
-	if err != nil {
-		return nil, fmt.Errorf("mtr not found in PATH: %v", err)
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("port %d out of range", cfg.Port)
+	}
+	if cfg.Pings < 0 {
+		return fmt.Errorf("pings must not be negative")
+	}
+	if cfg.MaxHops < 0 || cfg.MaxHops > 255 {
+		return fmt.Errorf("max_hops %d out of range (1-255)", cfg.MaxHops)
+	}
+	p := settings(cfg)
+	if run := time.Duration(p.rounds)*roundSpacing + p.timeout; cfg.Interval > 0 && cfg.Interval < run {
+		return fmt.Errorf("interval %s is shorter than a trace of %d rounds (%s)", cfg.Interval, p.rounds, run)
 	}
+	return nil
+}
 
-	// Default to 5 cycles
-	count := 5
-	return &MTRProbe{
+// settings fills in the defaults for cfg.
+func settings(cfg plugin.ProbeConfig) *MTRProbe {
+	p := &MTRProbe{
 		name:     cfg.Name,
 		target:   cfg.Target,
 		interval: cfg.Interval,
-		count:    count,
-		ipv6:     ipv6,
-		mtrPath:  mtrExe,
-	}, nil
+		proto:    cfg.Protocol,
+		port:     cfg.Port,
+		rounds:   cfg.Pings,
+		maxHops:  cfg.MaxHops,
+		timeout:  cfg.Timeout,
+		names:    make(map[string]string),
+		log:      plugin.ProbeLogger(cfg),
+	}
+	if p.proto == "" {
+		p.proto = "icmp"
+	}
+	if p.port == 0 && p.proto == "tcp" {
+		p.port = defaultTCPPort
+	}
+	if p.rounds <= 0 {
+		p.rounds = defaultRounds
+	}
+	if p.maxHops <= 0 {
+		p.maxHops = defaultMaxHops
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultTimeout
+	}
+	return p
+}
+
+// New creates a new MTRProbe. It defaults to IPv6, falling back to IPv4 if no IPv6 addresses are found,
+// unless the family is set explicitly.
+func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	ipv6, err := plugin.PreferIPv6(cfg.Target, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	p := settings(cfg)
+	p.ipv6 = ipv6
+	return p, nil
 }
 
 func (p *MTRProbe) Name() string {
@@ -85,72 +130,128 @@ func (p *MTRProbe) Interval() time.Duration {
 	return p.interval
 }
 
-func (p *MTRProbe) Run(ctx context.Context, out chan<- plugin.Metric) {
-	ticker := time.NewTicker(p.interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			fmt.Fprintf(os.Stderr, "▶️  running MTR probe %q -> %s (ipv6=%t)\n", p.name, p.target, p.ipv6)
-
-			// Build arguments
-			args := []string{"-r", "-c", strconv.Itoa(p.count)}
-			if p.ipv6 {
-				args = append(args, "-6")
-			} else {
-				args = append(args, "-4")
-			}
-			args = append(args, p.target)
-
-			// Execute mtr
-			cmd := exec.CommandContext(ctx, p.mtrPath, args...)
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "❌ mtr error for %q: %v\nOutput: %s\n", p.name, err, output)
-				out <- plugin.Metric{Probe: p.name, Time: time.Now().Unix(), Latency: -1}
-				continue
-			}
-			fmt.Fprintf(os.Stderr, "🗒 raw mtr output for %q:\n%s\n", p.name, output)
-
-			// Parse output
-			scanner := bufio.NewScanner(strings.NewReader(string(output)))
-			emitted := 0
-			for scanner.Scan() {
-				line := scanner.Text()
-				trimmed := strings.TrimSpace(line)
-				if trimmed == "" ||
-					strings.HasPrefix(trimmed, "HOST:") ||
-					strings.HasPrefix(trimmed, "Start:") ||
-					strings.Contains(trimmed, "Loss%") ||
-					strings.HasPrefix(trimmed, "My traceroute") {
-					continue
-				}
-				fields := strings.Fields(line)
-				if len(fields) < 6 {
-					continue
-				}
-				hop := fields[1]
-				avgStr := fields[5]
-				avg, err := strconv.ParseFloat(avgStr, 64)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "⚠️  parse error for %q line %q: %v\n", p.name, line, err)
-					continue
-				}
-				safeHop := strings.ReplaceAll(hop, "/", "_")
-				tag := fmt.Sprintf("%s_%s", p.name, safeHop)
-				out <- plugin.Metric{Probe: tag, Time: time.Now().Unix(), Latency: avg}
-				emitted++
-			}
-			if err := scanner.Err(); err != nil {
-				fmt.Fprintf(os.Stderr, "⚠️  scan error for %q: %v\n", p.name, err)
+func (p *MTRProbe) Run(ctx context.Context) []plugin.Metric {
+	return p.trace(ctx)
+}
+
+// trace runs one trace and returns its per-hop metrics, or a single
+// failure metric.
+func (p *MTRProbe) trace(ctx context.Context) []plugin.Metric {
+	fail := func(err error) []plugin.Metric {
+		p.log.Warn("trace failed", "target", p.target, "err", err)
+		m := p.newMetric()
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return []plugin.Metric{m}
+	}
+
+	ip, err := plugin.ResolveIP(ctx, p.target, p.ipv6)
+	if err != nil {
+		return fail(err)
+	}
+	hops, err := trace(ctx, p.proto, ip, p.port, p.rounds, p.maxHops, p.timeout)
+	if err != nil {
+		return fail(err)
+	}
+	if len(hops) == 0 {
+		return fail(fmt.Errorf("no hop answered"))
+	}
+
+	var metrics []plugin.Metric
+	for _, h := range hops {
+		recv := 0
+		for _, r := range h.responders {
+			recv += len(r.rtts)
+		}
+		loss := 100 * float64(h.sent-recv) / float64(h.sent)
+		if p.log.Enabled(logging.LevelDebug) {
+			var answers []string
+			for _, r := range h.responders {
+				answers = append(answers, fmt.Sprintf("%s/%d", r.addr, len(r.rtts)))
 			}
-			if emitted == 0 {
-				fmt.Fprintf(os.Stderr, "⚠️  no hops for %q, emitting placeholder\n", p.name)
-				out <- plugin.Metric{Probe: p.name, Time: time.Now().Unix(), Latency: -1}
+			p.log.Debug("hop", "ttl", h.ttl, "sent", h.sent, "answers", strings.Join(answers, " "))
+		}
+
+		if len(h.responders) == 0 {
+			m := p.hopMetric(h.ttl, silentHop)
+			m.Fields[plugin.FieldLoss] = loss
+			m.Fields["sent"] = float64(h.sent)
+			m.Fields["recv"] = 0
+			metrics = append(metrics, m)
+			continue
+		}
+		// under ECMP the loss is shared by the hop's responders
+		for _, r := range h.responders {
+			m := p.hopMetric(h.ttl, r.addr)
+			if name := p.lookup(ctx, r.addr); name != "" {
+				m.Tags[TagHostname] = name
 			}
+			m.Fields[plugin.FieldLoss] = loss
+			m.Fields["sent"] = float64(h.sent)
+			m.Fields["recv"] = float64(len(r.rtts))
+			rttStats(&m, r.rtts)
+			metrics = append(metrics, m)
 		}
 	}
+	if ev, ok := p.pathChange(hops); ok {
+		p.log.Info("path changed", "target", p.target, "hop", ev.Fields[plugin.FieldHop],
+			"old", ev.Text[TextOldPath], "new", ev.Text[TextPath])
+		metrics = append(metrics, ev)
+	}
+	return metrics
+}
+
+func (p *MTRProbe) newMetric() plugin.Metric {
+	m := plugin.NewMetric(p.name, "mtr")
+	m.Tags[plugin.TagTarget] = p.target
+	m.Tags[plugin.TagFamily] = plugin.Family(p.ipv6)
+	m.Tags[plugin.TagProtocol] = p.proto
+	return m
+}
+
+func (p *MTRProbe) hopMetric(ttl int, addr string) plugin.Metric {
+	m := p.newMetric()
+	m.Tags[plugin.TagHop] = strconv.Itoa(ttl)
+	m.Tags[plugin.TagAddr] = addr
+	m.Fields[plugin.FieldHop] = float64(ttl)
+	return m
+}
+
+// lookup returns the reverse DNS name of addr. Answers, including
+// failures, are cached for the life of the probe.
+func (p *MTRProbe) lookup(ctx context.Context, addr string) string {
+	if name, ok := p.names[addr]; ok {
+		return name
+	}
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	var name string
+	if names, err := net.DefaultResolver.LookupAddr(ctx, addr); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	p.names[addr] = name
+	return name
+}
+
+// rttStats sets rtt (the average), min, max, avg and stddev from rtts.
+func rttStats(m *plugin.Metric, rtts []float64) {
+	sorted := append([]float64(nil), rtts...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	avg := sum / float64(len(sorted))
+	var sq float64
+	for _, v := range sorted {
+		sq += (v - avg) * (v - avg)
+	}
+
+	m.Fields[plugin.FieldRTT] = avg
+	m.Fields["min"] = sorted[0]
+	m.Fields["max"] = sorted[len(sorted)-1]
+	m.Fields["avg"] = avg
+	m.Fields["stddev"] = math.Sqrt(sq / float64(len(sorted)))
+	m.RTTs = sorted
 }
@@ -0,0 +1,101 @@
+package mtr
+
+import (
+	"sort"
+	"strings"
+
+	"tokeping/pkg/plugin"
+)
+
+// Text values of a path change event. They are not tags: every route
+// seen would be a new series.
+const (
+	TextPath    = "path"
+	TextOldPath = "old_path"
+)
+
+// path is the sorted responder addresses of each hop of a trace, with
+// silentHop where nothing answered.
+type path [][]string
+
+func pathOf(hops []hop) path {
+	p := make(path, len(hops))
+	for i, h := range hops {
+		if len(h.responders) == 0 {
+			p[i] = []string{silentHop}
+			continue
+		}
+		for _, r := range h.responders {
+			p[i] = append(p[i], r.addr)
+		}
+		sort.Strings(p[i])
+	}
+	return p
+}
+
+// String writes p as "a > b|c > ???", with ECMP responders joined by "|".
+func (p path) String() string {
+	hops := make([]string, len(p))
+	for i, addrs := range p {
+		hops[i] = strings.Join(addrs, "|")
+	}
+	return strings.Join(hops, " > ")
+}
+
+// differs returns the first hop, counting from 1, at which the paths
+// disagree, or 0 if they are the same. A silent hop matches anything, as
+// routers often rate-limit their ICMP errors, and hops match as long as
+// they share a responder, so ECMP paths that are not sampled on every run
+// do not count as a change.
+func (p path) differs(other path) int {
+	n := len(p)
+	if len(other) < n {
+		n = len(other)
+	}
+	for i := 0; i < n; i++ {
+		if p[i][0] == silentHop || other[i][0] == silentHop {
+			continue
+		}
+		if !shares(p[i], other[i]) {
+			return i + 1
+		}
+	}
+	if len(p) != len(other) {
+		return n + 1
+	}
+	return 0
+}
+
+func shares(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathChange remembers the path of the latest trace and returns an event
+// metric if it differs from the previous one.
+func (p *MTRProbe) pathChange(hops []hop) (plugin.Metric, bool) {
+	cur := pathOf(hops)
+	old := p.path
+	p.path = cur
+	if old == nil {
+		return plugin.Metric{}, false
+	}
+	at := old.differs(cur)
+	if at == 0 {
+		return plugin.Metric{}, false
+	}
+
+	m := p.newMetric()
+	m.Tags[plugin.TagEvent] = plugin.EventPathChange
+	m.Text = map[string]string{TextOldPath: old.String(), TextPath: cur.String()}
+	m.Fields[plugin.FieldHop] = float64(at)
+	m.Fields["hops"] = float64(len(cur))
+	m.Fields["old_hops"] = float64(len(old))
+	return m, true
+}
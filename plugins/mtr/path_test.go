@@ -0,0 +1,71 @@
+package mtr
+
+import (
+	"strings"
+	"testing"
+
+	"tokeping/pkg/plugin"
+)
+
+// hops builds the hops of a trace from "a|b > ??? > c" notation.
+func hops(s string) []hop {
+	var hs []hop
+	for i, h := range strings.Split(s, " > ") {
+		hp := hop{ttl: i + 1}
+		if h != silentHop {
+			for _, addr := range strings.Split(h, "|") {
+				hp.add(addr, 1)
+			}
+		}
+		hs = append(hs, hp)
+	}
+	return hs
+}
+
+func TestDiffers(t *testing.T) {
+	tests := []struct {
+		old, cur string
+		want     int
+	}{
+		{"a > b > c", "a > b > c", 0},
+		{"a > b > c", "a > x > c", 2},
+		{"a > ??? > c", "a > b > c", 0},
+		{"a > b|d > c", "a > d > c", 0},
+		{"a > b > c", "a > b", 3},
+		{"a > b", "a > b > c", 3},
+	}
+	for _, tt := range tests {
+		if got := pathOf(hops(tt.old)).differs(pathOf(hops(tt.cur))); got != tt.want {
+			t.Errorf("%q vs %q: got hop %d, want %d", tt.old, tt.cur, got, tt.want)
+		}
+	}
+}
+
+func TestPathChange(t *testing.T) {
+	p := &MTRProbe{name: "test", target: "c", proto: "icmp"}
+	if _, ok := p.pathChange(hops("a > b > c")); ok {
+		t.Fatal("event on the first trace")
+	}
+	if _, ok := p.pathChange(hops("a > ??? > c")); ok {
+		t.Fatal("event for a silent hop")
+	}
+	if _, ok := p.pathChange(hops("a > b > c")); ok {
+		t.Fatal("event for the same path")
+	}
+	m, ok := p.pathChange(hops("a > d|e > c"))
+	if !ok {
+		t.Fatal("no event for a changed hop")
+	}
+	if m.Tags[plugin.TagEvent] != plugin.EventPathChange || m.Fields[plugin.FieldHop] != 2 {
+		t.Errorf("event tags %v, fields %v", m.Tags, m.Fields)
+	}
+	// the routes are text, not tags
+	if m.Text[TextOldPath] != "a > b > c" || m.Text[TextPath] != "a > d|e > c" {
+		t.Errorf("event text %v", m.Text)
+	}
+	for _, k := range []string{TextPath, TextOldPath} {
+		if _, ok := m.Tags[k]; ok {
+			t.Errorf("%s is a tag", k)
+		}
+	}
+}
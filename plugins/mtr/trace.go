@@ -0,0 +1,405 @@
+package mtr
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"tokeping/pkg/plugin"
+)
+
+const (
+	// First destination port of udp traces, as in classic traceroute.
+	udpBasePort = 33434
+
+	// Time taken to send one probe to every TTL, like mtr's default
+	// one-second interval between cycles.
+	roundSpacing = time.Second
+)
+
+// IP protocol numbers as found in the packets quoted by ICMP errors.
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// hop is everything heard back from one TTL during a trace.
+type hop struct {
+	ttl        int
+	sent       int
+	responders []*responder // in order of first reply; several under ECMP
+}
+
+type responder struct {
+	addr string
+	rtts []float64 // ms
+}
+
+func (h *hop) add(addr string, rtt float64) {
+	for _, r := range h.responders {
+		if r.addr == addr {
+			r.rtts = append(r.rtts, rtt)
+			return
+		}
+	}
+	h.responders = append(h.responders, &responder{addr: addr, rtts: []float64{rtt}})
+}
+
+// reply is one answer to a TTL-limited probe. last is set when it came
+// from the destination, or was an unreachable that ends the path.
+type reply struct {
+	ttl  int
+	addr string
+	rtt  float64
+	last bool
+}
+
+type sent struct {
+	ttl int
+	at  time.Time
+}
+
+// tracer runs a single trace. Each probe is identified in the ICMP error
+// it causes by a key taken from the headers the router quotes back: the
+// echo sequence number for icmp, the destination port for udp and the
+// source port for tcp.
+type tracer struct {
+	proto   string
+	dst     net.IP
+	ipv6    bool
+	port    int // tcp destination port
+	maxHops int
+	timeout time.Duration
+
+	conn    *icmp.PacketConn // receives ICMP, and sends icmp probes
+	udp     net.PacketConn
+	udpPort int
+	id      int
+	seq     int
+	dials   sync.WaitGroup
+
+	mu      sync.Mutex
+	pending map[int]sent
+	sent    []int // probes sent per TTL
+	replies []reply
+	last    int // lowest TTL that ended the path, 0 while unknown
+}
+
+// trace sends rounds of probes with TTLs 1 up to maxHops towards dst and
+// returns the hops up to the destination, or up to the last TTL that
+// answered at all if the destination was never reached. Once the
+// destination has answered, later probes stop at its TTL.
+func trace(ctx context.Context, proto string, dst net.IP, port, rounds, maxHops int, timeout time.Duration) ([]hop, error) {
+	t := &tracer{
+		proto:   proto,
+		dst:     dst,
+		ipv6:    dst.To4() == nil,
+		port:    port,
+		maxHops: maxHops,
+		timeout: timeout,
+		id:      rand.Intn(0xffff),
+		pending: make(map[int]sent),
+		sent:    make([]int, maxHops+1),
+	}
+
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	if t.ipv6 {
+		network, laddr = "ip6:ipv6-icmp", "::"
+	}
+	conn, err := icmp.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening for ICMP (needs root or CAP_NET_RAW): %w", err)
+	}
+	t.conn = conn
+	defer conn.Close()
+
+	if proto == "udp" {
+		network := "udp4"
+		if t.ipv6 {
+			network = "udp6"
+		}
+		t.udp, err = net.ListenPacket(network, ":0")
+		if err != nil {
+			return nil, err
+		}
+		defer t.udp.Close()
+		t.udpPort = t.udp.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.listen()
+		close(done)
+	}()
+
+	err = t.run(ctx, rounds)
+	conn.Close()
+	<-done
+	t.dials.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return t.hops(), nil
+}
+
+func (t *tracer) run(ctx context.Context, rounds int) error {
+	for round := 0; round < rounds; round++ {
+		limit := t.limit()
+		spacing := roundSpacing / time.Duration(limit)
+		for ttl := 1; ttl <= limit && ttl <= t.limit(); ttl++ {
+			if err := t.send(ctx, ttl); err != nil {
+				return err
+			}
+			if !sleep(ctx, spacing) {
+				return ctx.Err()
+			}
+		}
+	}
+	// give the last probes their full timeout
+	if !sleep(ctx, t.timeout) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// limit is the highest TTL still worth probing.
+func (t *tracer) limit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last > 0 {
+		return t.last
+	}
+	return t.maxHops
+}
+
+// expect registers a probe about to be sent under key.
+func (t *tracer) expect(key, ttl int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[key] = sent{ttl: ttl, at: time.Now()}
+	t.sent[ttl]++
+}
+
+func (t *tracer) send(ctx context.Context, ttl int) error {
+	t.seq++
+	switch t.proto {
+	case "udp":
+		key := udpBasePort + t.seq%(0xffff-udpBasePort)
+		if err := setTTL(t.udp, t.ipv6, ttl); err != nil {
+			return err
+		}
+		t.expect(key, ttl)
+		_, err := t.udp.WriteTo([]byte("tokeping"), &net.UDPAddr{IP: t.dst, Port: key})
+		return err
+	case "tcp":
+		t.dials.Add(1)
+		go func() {
+			defer t.dials.Done()
+			t.dial(ctx, ttl)
+		}()
+		return nil
+	default:
+		key := t.seq & 0xffff
+		var typ icmp.Type = ipv4.ICMPTypeEcho
+		if t.ipv6 {
+			typ = ipv6.ICMPTypeEchoRequest
+		}
+		msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: t.id, Seq: key, Data: []byte("tokeping")}}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		if t.ipv6 {
+			err = t.conn.IPv6PacketConn().SetHopLimit(ttl)
+		} else {
+			err = t.conn.IPv4PacketConn().SetTTL(ttl)
+		}
+		if err != nil {
+			return err
+		}
+		t.expect(key, ttl)
+		_, err = t.conn.WriteTo(b, &net.IPAddr{IP: t.dst})
+		return err
+	}
+}
+
+// dial starts a TCP handshake with a limited TTL. Routers on the way answer
+// the SYN with time exceeded, which listen picks up by the source port.
+// The destination answers with SYN-ACK or RST, either of which ends the
+// path.
+func (t *tracer) dial(ctx context.Context, ttl int) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	network := "tcp4"
+	if t.ipv6 {
+		network = "tcp6"
+	}
+	var key int
+	d := net.Dialer{Control: ttlControl(ttl, t.ipv6, func(port int) {
+		key = port
+		t.expect(key, ttl)
+	})}
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(t.dst.String(), fmt.Sprint(t.port)))
+	at := time.Now()
+	if err == nil {
+		conn.Close()
+	}
+	if key == 0 {
+		return
+	}
+	if err == nil || plugin.ClassifyError(err) == plugin.FailureRefused {
+		t.record(key, t.dst.String(), at, true)
+		return
+	}
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+}
+
+func setTTL(c net.PacketConn, v6 bool, ttl int) error {
+	if v6 {
+		return ipv6.NewPacketConn(c).SetHopLimit(ttl)
+	}
+	return ipv4.NewPacketConn(c).SetTTL(ttl)
+}
+
+// listen reads ICMP until the connection is closed.
+func (t *tracer) listen() {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+		if key, last, ok := t.match(buf[:n]); ok {
+			t.record(key, peer.(*net.IPAddr).IP.String(), at, last)
+		}
+	}
+}
+
+// match returns the key of the probe an ICMP message answers, if it
+// answers one of ours.
+func (t *tracer) match(b []byte) (key int, last bool, ok bool) {
+	proto := protoICMP
+	if t.ipv6 {
+		proto = protoICMPv6
+	}
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return 0, false, false
+	}
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if t.proto != "icmp" || body.ID != t.id ||
+			(msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+			return 0, false, false
+		}
+		return body.Seq, true, true
+	case *icmp.TimeExceeded:
+		key, ok = t.quoted(body.Data)
+		return key, false, ok
+	case *icmp.DstUnreach:
+		key, ok = t.quoted(body.Data)
+		return key, true, ok
+	}
+	return 0, false, false
+}
+
+// quoted finds the probe key in the packet quoted by an ICMP error.
+func (t *tracer) quoted(b []byte) (int, bool) {
+	var proto int
+	var dst net.IP
+	if t.ipv6 {
+		if len(b) < 40 {
+			return 0, false
+		}
+		proto, dst, b = int(b[6]), net.IP(b[24:40]), b[40:]
+	} else {
+		if len(b) < 20 || len(b) < int(b[0]&0x0f)*4 {
+			return 0, false
+		}
+		proto, dst, b = int(b[9]), net.IP(b[16:20]), b[int(b[0]&0x0f)*4:]
+	}
+	if !dst.Equal(t.dst) || len(b) < 8 {
+		return 0, false
+	}
+	port := func(i int) int { return int(binary.BigEndian.Uint16(b[i : i+2])) }
+
+	switch t.proto {
+	case "udp":
+		return port(2), proto == protoUDP && port(0) == t.udpPort
+	case "tcp":
+		return port(0), proto == protoTCP && port(2) == t.port
+	default:
+		return port(6), (proto == protoICMP || proto == protoICMPv6) && port(4) == t.id
+	}
+}
+
+// record stores the reply to the probe sent under key. Late and duplicate
+// replies are ignored.
+func (t *tracer) record(key int, addr string, at time.Time, last bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.pending[key]
+	if !ok {
+		return
+	}
+	delete(t.pending, key)
+	rtt := at.Sub(s.at)
+	if rtt > t.timeout {
+		return
+	}
+	t.replies = append(t.replies, reply{ttl: s.ttl, addr: addr, rtt: rtt.Seconds() * 1000, last: last})
+	if last && (t.last == 0 || s.ttl < t.last) {
+		t.last = s.ttl
+	}
+}
+
+func (t *tracer) hops() []hop {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.last
+	if n == 0 {
+		for _, r := range t.replies {
+			if r.ttl > n {
+				n = r.ttl
+			}
+		}
+	}
+	hops := make([]hop, n)
+	for i := range hops {
+		hops[i] = hop{ttl: i + 1, sent: t.sent[i+1]}
+	}
+	for _, r := range t.replies {
+		// the destination also answers probes sent past it before
+		// its TTL was known
+		if r.ttl <= n {
+			hops[r.ttl-1].add(r.addr, r.rtt)
+		}
+	}
+	return hops
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
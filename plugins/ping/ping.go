@@ -2,48 +2,184 @@ package ping
 
 import (
     "context"
+    "fmt"
+    "math"
+    "sort"
     "time"
 
     "github.com/go-ping/ping"
+    "tokeping/pkg/logging"
     "tokeping/pkg/plugin"
 )
 
+// Default number of echo requests sent per round, matching smokeping.
+const defaultPings = 20
+
+// Spacing between echo requests within a round.
+const pingSpacing = time.Second
+
 type PingProbe struct {
     name     string
     target   string
     interval time.Duration
+    pings    int
+    log      *logging.Logger
 }
 
 func init() {
     plugin.RegisterProbe("ping", New)
+    plugin.RegisterProbeValidator("ping", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+    if cfg.Pings < 0 {
+        return fmt.Errorf("pings must not be negative")
+    }
+    // only an explicit pings can be too many; the default is fitted below
+    if round := time.Duration(cfg.Pings+1) * pingSpacing; cfg.Pings > 0 && cfg.Interval > 0 && cfg.Interval < round {
+        return fmt.Errorf("interval %s is shorter than a round of %d pings (%s)", cfg.Interval, cfg.Pings, round)
+    }
+    return nil
 }
 
 func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
-    return &PingProbe{cfg.Name, cfg.Target, cfg.Interval}, nil
+    return &PingProbe{cfg.Name, cfg.Target, cfg.Interval, roundPings(cfg), plugin.ProbeLogger(cfg)}, nil
+}
+
+// roundPings returns the echo requests to send per round: pings if set,
+// otherwise the default, cut down to what fits in the interval so that
+// probes with short intervals keep working.
+func roundPings(cfg plugin.ProbeConfig) int {
+    if cfg.Pings > 0 {
+        return cfg.Pings
+    }
+    pings := defaultPings
+    if fit := int(cfg.Interval/pingSpacing) - 1; cfg.Interval > 0 && fit < pings {
+        pings = fit
+    }
+    if pings < 1 {
+        pings = 1
+    }
+    return pings
 }
 
 func (p *PingProbe) Name() string           { return p.name }
 func (p *PingProbe) Interval() time.Duration { return p.interval }
-func (p *PingProbe) Run(ctx context.Context, out chan<- plugin.Metric) {
-    ticker := time.NewTicker(p.interval)
-    defer ticker.Stop()
-    for {
+func (p *PingProbe) Run(ctx context.Context) []plugin.Metric {
+    pr, err := ping.NewPinger(p.target)
+    if err != nil {
+        m := plugin.NewMetric(p.name, "ping")
+        m.Tags[plugin.TagTarget] = p.target
+        m.Fail(err)
+        p.log.Warn("round failed", "target", p.target, "err", err)
+        return []plugin.Metric{m}
+    }
+    pr.Count = p.pings
+    pr.Interval = pingSpacing
+    // Without a timeout a single lost packet keeps Run waiting
+    // forever; allow the whole round plus one spacing for stragglers.
+    pr.Timeout = time.Duration(p.pings+1) * pingSpacing
+
+    // go-ping knows nothing of contexts; stop the round at the deadline
+    // and report what came back so far
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
         select {
         case <-ctx.Done():
-            return
-        case <-ticker.C:
-            pr, err := ping.NewPinger(p.target)
-            if err != nil {
-                continue
-            }
-            pr.Count = 1
-            pr.Run()
-            stats := pr.Statistics()
-            out <- plugin.Metric{
-                Probe:   p.name,
-                Time:    time.Now().Unix(),
-                Latency: stats.AvgRtt.Seconds() * 1000,
-            }
+            pr.Stop()
+        case <-done:
         }
+    }()
+    err = pr.Run()
+    stats := pr.Statistics()
+    p.log.Debug("round done", "addr", stats.Addr, "sent", stats.PacketsSent, "recv", stats.PacketsRecv,
+        "duplicates", stats.PacketsRecvDuplicates)
+    m := roundMetric(p.name, stats)
+    m.Tags[plugin.TagTarget] = p.target
+    m.Tags[plugin.TagFamily] = plugin.Family(pr.IPAddr().IP.To4() == nil)
+    if err == nil && ctx.Err() != nil {
+        err = fmt.Errorf("round cut short after %d of %d pings: %w", pr.PacketsSent, p.pings, ctx.Err())
+        m.Tags[plugin.TagFailure] = plugin.FailureTimeout
+    }
+    if err != nil {
+        m.Fail(err)
+    }
+    if m.Error != "" {
+        p.log.Warn("round failed", "target", p.target, "err", m.Error)
+    }
+    return []plugin.Metric{m}
+}
+
+// roundMetric summarises one round of pings. The rtt field is the median
+// (smokeping's headline value); a round with no replies is a failure.
+func roundMetric(name string, stats *ping.Statistics) plugin.Metric {
+    m := plugin.NewMetric(name, "ping")
+    m.Fields["sent"] = float64(stats.PacketsSent)
+    m.Fields["recv"] = float64(stats.PacketsRecv)
+    m.Fields[plugin.FieldLoss] = lossPercent(stats.PacketsSent, stats.PacketsRecv)
+    if len(stats.Rtts) == 0 {
+        m.Fail(fmt.Errorf("no replies from %s", stats.Addr))
+        return m
+    }
+
+    // jitter is computed in arrival order, before sorting
+    rtts := make([]float64, len(stats.Rtts))
+    for i, d := range stats.Rtts {
+        rtts[i] = float64(d) / float64(time.Millisecond)
+    }
+    m.Fields[plugin.FieldJitter] = jitter(rtts)
+
+    sort.Float64s(rtts)
+    m.RTTs = rtts
+    m.Fields[plugin.FieldRTT] = median(rtts)
+    m.Fields["min"] = rtts[0]
+    m.Fields["max"] = rtts[len(rtts)-1]
+    m.Fields["avg"], m.Fields["stddev"] = meanStddev(rtts)
+    return m
+}
+
+func lossPercent(sent, recv int) float64 {
+    if sent == 0 {
+        return 100
+    }
+    if recv > sent {
+        // duplicates can push recv above sent
+        recv = sent
+    }
+    return float64(sent-recv) / float64(sent) * 100
+}
+
+// median expects sorted input.
+func median(v []float64) float64 {
+    n := len(v)
+    if n%2 == 1 {
+        return v[n/2]
+    }
+    return (v[n/2-1] + v[n/2]) / 2
+}
+
+func meanStddev(v []float64) (float64, float64) {
+    var sum float64
+    for _, x := range v {
+        sum += x
+    }
+    mean := sum / float64(len(v))
+    var sq float64
+    for _, x := range v {
+        sq += (x - mean) * (x - mean)
+    }
+    return mean, math.Sqrt(sq / float64(len(v)))
+}
+
+// jitter is the mean absolute difference between consecutive RTTs.
+func jitter(v []float64) float64 {
+    if len(v) < 2 {
+        return 0
+    }
+    var sum float64
+    for i := 1; i < len(v); i++ {
+        sum += math.Abs(v[i] - v[i-1])
     }
+    return sum / float64(len(v)-1)
 }
@@ -0,0 +1,147 @@
+package ping
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-ping/ping"
+	"tokeping/pkg/plugin"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		pings    int
+		ok       bool
+	}{
+		// without pings any interval is fine, the default is fitted
+		{5 * time.Second, 0, true},
+		{time.Second, 0, true},
+		{30 * time.Second, 20, true},
+		{21 * time.Second, 20, true},
+		{20 * time.Second, 20, false},
+		{5 * time.Second, 4, true},
+		{5 * time.Second, 5, false},
+		{time.Minute, -1, false},
+	}
+	for _, tt := range tests {
+		err := validate(plugin.ProbeConfig{Interval: tt.interval, Pings: tt.pings})
+		if (err == nil) != tt.ok {
+			t.Errorf("interval %s, pings %d: %v, want ok=%v", tt.interval, tt.pings, err, tt.ok)
+		}
+	}
+}
+
+func TestRoundPings(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		pings    int
+		want     int
+	}{
+		{time.Minute, 0, 20},
+		{21 * time.Second, 0, 20},
+		{20 * time.Second, 0, 19},
+		{5 * time.Second, 0, 4},
+		{1500 * time.Millisecond, 0, 1},
+		{time.Second, 0, 1},
+		{time.Minute, 5, 5},
+	}
+	for _, tt := range tests {
+		got := roundPings(plugin.ProbeConfig{Interval: tt.interval, Pings: tt.pings})
+		if got != tt.want {
+			t.Errorf("interval %s, pings %d: got %d, want %d", tt.interval, tt.pings, got, tt.want)
+		}
+	}
+}
+
+func TestLossPercent(t *testing.T) {
+	tests := []struct {
+		sent, recv int
+		want       float64
+	}{
+		{20, 20, 0},
+		{20, 15, 25},
+		{20, 0, 100},
+		{0, 0, 100},
+		// duplicates
+		{4, 5, 0},
+	}
+	for _, tt := range tests {
+		if got := lossPercent(tt.sent, tt.recv); got != tt.want {
+			t.Errorf("lossPercent(%d, %d) = %v, want %v", tt.sent, tt.recv, got, tt.want)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		rtts         []float64
+		median       float64
+		mean, stddev float64
+		jitter       float64
+	}{
+		{"one", []float64{5}, 5, 5, 0, 0},
+		{"odd", []float64{1, 3, 2}, 2, 2, math.Sqrt(2.0 / 3), 1.5},
+		{"even", []float64{4, 1, 3, 2}, 2.5, 2.5, math.Sqrt(1.25), 2},
+		{"steady", []float64{7, 7, 7}, 7, 7, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// jitter is in arrival order, the rest on sorted values
+			if got := jitter(tt.rtts); !near(got, tt.jitter) {
+				t.Errorf("jitter = %v, want %v", got, tt.jitter)
+			}
+			sorted := append([]float64(nil), tt.rtts...)
+			sort.Float64s(sorted)
+			if got := median(sorted); got != tt.median {
+				t.Errorf("median = %v, want %v", got, tt.median)
+			}
+			mean, stddev := meanStddev(sorted)
+			if !near(mean, tt.mean) || !near(stddev, tt.stddev) {
+				t.Errorf("meanStddev = %v, %v, want %v, %v", mean, stddev, tt.mean, tt.stddev)
+			}
+		})
+	}
+}
+
+func TestRoundMetric(t *testing.T) {
+	ms := func(v ...int) []time.Duration {
+		d := make([]time.Duration, len(v))
+		for i, x := range v {
+			d[i] = time.Duration(x) * time.Millisecond
+		}
+		return d
+	}
+	m := roundMetric("test", &ping.Statistics{Addr: "192.0.2.1", PacketsSent: 5, PacketsRecv: 4, Rtts: ms(10, 30, 20, 40)})
+	if m.Status != plugin.StatusOK {
+		t.Fatalf("status %s (%s)", m.Status, m.Error)
+	}
+	want := map[string]float64{
+		"sent": 5, "recv": 4, plugin.FieldLoss: 20,
+		plugin.FieldRTT: 25, "min": 10, "max": 40, "avg": 25,
+		plugin.FieldJitter: 50.0 / 3,
+	}
+	for k, v := range want {
+		if !near(m.Fields[k], v) {
+			t.Errorf("field %s = %v, want %v", k, m.Fields[k], v)
+		}
+	}
+	if len(m.RTTs) != 4 || !sort.Float64sAreSorted(m.RTTs) {
+		t.Errorf("RTTs %v, want 4 sorted values", m.RTTs)
+	}
+
+	m = roundMetric("test", &ping.Statistics{Addr: "192.0.2.1", PacketsSent: 5})
+	if m.Status != plugin.StatusError || m.Fields[plugin.FieldLoss] != 100 {
+		t.Errorf("no replies: status %s, loss %v", m.Status, m.Fields[plugin.FieldLoss])
+	}
+	if _, ok := m.Fields[plugin.FieldRTT]; ok {
+		t.Errorf("no replies: unexpected rtt %v", m.Fields[plugin.FieldRTT])
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,210 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+	"tokeping/pkg/stats"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Labels on every per-probe series. hop is empty except for mtr hops, addr
+// unless the probe reports the address it reached; for mtr it separates
+// the ECMP responders of one hop.
+var labels = []string{"probe", "type", "target", "hop", "addr"}
+
+// RTT histogram buckets in seconds, 0.5ms to 5s.
+var rttBuckets = []float64{.0005, .001, .002, .005, .01, .02, .05, .1, .2, .5, 1, 2, 5}
+
+// PromOutput serves the latest probe results in the Prometheus text format.
+type PromOutput struct {
+	addr   string
+	path   string
+	server *http.Server
+	log    *logging.Logger
+
+	rtt  *prometheus.GaugeVec
+	loss *prometheus.GaugeVec
+	up   *prometheus.GaugeVec
+	hist *prometheus.HistogramVec
+
+	pathChanges *prometheus.CounterVec
+}
+
+func init() {
+	plugin.RegisterOutput("prometheus", New)
+	plugin.RegisterOutputValidator("prometheus", func(cfg plugin.OutputConfig) error {
+		if cfg.Listen == "" {
+			return errors.New("prometheus output needs a listen address")
+		}
+		return nil
+	})
+}
+
+func New(cfg plugin.OutputConfig) (plugin.Output, error) {
+	path := cfg.Path
+	if path == "" {
+		path = "/metrics"
+	}
+
+	o := &PromOutput{
+		addr: cfg.Listen,
+		path: path,
+		log:  logging.New("prometheus").With("output", cfg.Name),
+		rtt: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tokeping_rtt_seconds",
+			Help: "Latest round-trip time reported by the probe.",
+		}, labels),
+		loss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tokeping_loss_ratio",
+			Help: "Latest packet loss reported by the probe, 0 to 1.",
+		}, labels),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tokeping_probe_success",
+			Help: "Whether the latest probe run succeeded (1) or failed (0).",
+		}, labels),
+		hist: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tokeping_rtt_distribution_seconds",
+			Help:    "Distribution of individual round-trip times.",
+			Buckets: rttBuckets,
+		}, labels),
+		pathChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tokeping_path_changes_total",
+			Help: "Route changes seen by the probe.",
+		}, []string{"probe", "target"}),
+	}
+
+	// own registry, so the output can be restarted on reload
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(o.rtt, o.loss, o.up, o.hist, o.pathChanges, healthCollector{})
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	o.server = &http.Server{Addr: cfg.Listen, Handler: mux}
+	return o, nil
+}
+
+func (o *PromOutput) Name() string { return "prometheus" }
+
+func (o *PromOutput) Start() error {
+	o.log.Info("exporter listening", "listen", o.addr, "path", o.path)
+	go func() {
+		if err := o.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			o.log.Error("HTTP server failed", "listen", o.addr, "err", err)
+		}
+	}()
+	return nil
+}
+
+func (o *PromOutput) Send(m plugin.Metric) {
+	switch m.Tags[plugin.TagEvent] {
+	case "":
+	case plugin.EventPathChange:
+		o.pathChanges.WithLabelValues(m.Probe, m.Tags[plugin.TagTarget]).Inc()
+		return
+	case plugin.EventProbeStopped:
+		o.forget(m.Probe)
+		return
+	default:
+		return
+	}
+	lv := prometheus.Labels{
+		"probe":  m.Probe,
+		"type":   m.Type,
+		"target": m.Tags[plugin.TagTarget],
+		"hop":    m.Tags[plugin.TagHop],
+		"addr":   m.Tags[plugin.TagAddr],
+	}
+	// a failed ping round still knows its loss
+	if v, ok := m.Fields[plugin.FieldLoss]; ok {
+		o.loss.With(lv).Set(v / 100)
+	}
+	if m.Status != plugin.StatusOK {
+		o.up.With(lv).Set(0)
+		// rather than the last good value
+		o.rtt.With(lv).Set(math.NaN())
+		return
+	}
+	o.up.With(lv).Set(1)
+
+	rtt, ok := m.Fields[plugin.FieldRTT]
+	if !ok {
+		return
+	}
+	o.rtt.With(lv).Set(rtt / 1000)
+
+	// observe every sample of a multi-ping round, not just the median
+	hist := o.hist.With(lv)
+	if len(m.RTTs) > 0 {
+		for _, v := range m.RTTs {
+			hist.Observe(v / 1000)
+		}
+	} else {
+		hist.Observe(rtt / 1000)
+	}
+}
+
+// forget deletes every series of a probe that was stopped.
+func (o *PromOutput) forget(probe string) {
+	match := prometheus.Labels{"probe": probe}
+	o.rtt.DeletePartialMatch(match)
+	o.loss.DeletePartialMatch(match)
+	o.up.DeletePartialMatch(match)
+	o.hist.DeletePartialMatch(match)
+	o.pathChanges.DeletePartialMatch(match)
+}
+
+func (o *PromOutput) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return o.server.Shutdown(ctx)
+}
+
+var (
+	resultsDesc = prometheus.NewDesc("tokeping_probe_results_total",
+		"Results received from the probe.", []string{"probe"}, nil)
+	errorsDesc = prometheus.NewDesc("tokeping_probe_errors_total",
+		"Failed results received from the probe.", []string{"probe"}, nil)
+	timeoutsDesc = prometheus.NewDesc("tokeping_probe_timeouts_total",
+		"Probe runs that hit their deadline.", []string{"probe"}, nil)
+	overrunsDesc = prometheus.NewDesc("tokeping_probe_overruns_total",
+		"Probe runs that took longer than the interval.", []string{"probe"}, nil)
+	skippedDesc = prometheus.NewDesc("tokeping_probe_skipped_total",
+		"Probe runs skipped because the previous run had not finished.", []string{"probe"}, nil)
+	droppedDesc = prometheus.NewDesc("tokeping_output_dropped_total",
+		"Metrics the output discarded because its queue was full.", []string{"output"}, nil)
+)
+
+// healthCollector exports tokeping's own counters from package stats.
+type healthCollector struct{}
+
+func (healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- resultsDesc
+	ch <- errorsDesc
+	ch <- timeoutsDesc
+	ch <- overrunsDesc
+	ch <- skippedDesc
+	ch <- droppedDesc
+}
+
+func (healthCollector) Collect(ch chan<- prometheus.Metric) {
+	collect(ch, resultsDesc, stats.ProbeResults)
+	collect(ch, errorsDesc, stats.ProbeErrors)
+	collect(ch, timeoutsDesc, stats.ProbeTimeouts)
+	collect(ch, overrunsDesc, stats.ProbeOverruns)
+	collect(ch, skippedDesc, stats.ProbeSkipped)
+	collect(ch, droppedDesc, stats.OutputDropped)
+}
+
+func collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, c *stats.CounterVec) {
+	for k, v := range c.Snapshot() {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), k)
+	}
+}
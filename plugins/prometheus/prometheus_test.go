@@ -0,0 +1,95 @@
+package prometheus
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"tokeping/pkg/plugin"
+)
+
+// scrape returns the lines of the handler's output that mention probe.
+func scrape(t *testing.T, o *PromOutput, probe string) []string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	o.server.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 {
+		t.Fatalf("scrape: status %d", rec.Code)
+	}
+	var lines []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.Contains(line, `probe="`+probe+`"`) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// value returns the value of the series of name in lines.
+func value(lines []string, name string) (string, bool) {
+	for _, line := range lines {
+		if strings.HasPrefix(line, name+"{") {
+			return line[strings.LastIndex(line, " ")+1:], true
+		}
+	}
+	return "", false
+}
+
+func metric(probe string, rtt float64, err error) plugin.Metric {
+	m := plugin.NewMetric(probe, "ping")
+	m.Tags[plugin.TagTarget] = "192.0.2.1"
+	m.Fields[plugin.FieldLoss] = 0
+	if err != nil {
+		m.Fields[plugin.FieldLoss] = 100
+		m.Fail(err)
+	} else {
+		m.Fields[plugin.FieldRTT] = rtt
+	}
+	return m
+}
+
+func TestSend(t *testing.T) {
+	out, err := New(plugin.OutputConfig{Name: "prom", Type: "prometheus", Listen: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := out.(*PromOutput)
+
+	o.Send(metric("a", 12.5, nil))
+	o.Send(metric("b", 20, nil))
+	lines := scrape(t, o, "a")
+	for name, want := range map[string]string{
+		"tokeping_rtt_seconds":                    "0.0125",
+		"tokeping_loss_ratio":                     "0",
+		"tokeping_probe_success":                  "1",
+		"tokeping_rtt_distribution_seconds_count": "1",
+	} {
+		if got, _ := value(lines, name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	// a failure does not leave the last good rtt behind
+	o.Send(metric("a", 0, errors.New("no replies from 192.0.2.1")))
+	lines = scrape(t, o, "a")
+	for name, want := range map[string]string{
+		"tokeping_rtt_seconds":   "NaN",
+		"tokeping_loss_ratio":    "1",
+		"tokeping_probe_success": "0",
+	} {
+		if got, _ := value(lines, name); got != want {
+			t.Errorf("after a failure, %s = %q, want %q", name, got, want)
+		}
+	}
+
+	stopped := plugin.NewMetric("a", "ping")
+	stopped.Tags[plugin.TagEvent] = plugin.EventProbeStopped
+	o.Send(stopped)
+	if lines := scrape(t, o, "a"); len(lines) > 0 {
+		t.Errorf("series of a stopped probe are still exported:\n%s", strings.Join(lines, "\n"))
+	}
+	if got, _ := value(scrape(t, o, "b"), "tokeping_rtt_seconds"); got != "0.02" {
+		t.Errorf("the other probe's rtt = %q, want 0.02", got)
+	}
+}
@@ -0,0 +1,112 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// TCPProbe measures the time to complete a TCP handshake with host:port.
+// Useful where ICMP is filtered but the service port is reachable.
+type TCPProbe struct {
+	name     string
+	target   string
+	host     string
+	port     string
+	interval time.Duration
+	timeout  time.Duration
+	ipv6     bool
+	log      *logging.Logger
+}
+
+func init() {
+	plugin.RegisterProbe("tcp", New)
+	plugin.RegisterProbeValidator("tcp", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+	if _, _, err := net.SplitHostPort(cfg.Target); err != nil {
+		return fmt.Errorf("tcp target must be host:port: %v", err)
+	}
+	return nil
+}
+
+// New creates a TCPProbe for a "host:port" target. Like the other probes it
+// defaults to IPv6 unless the family is set or the host is legacy-IP only.
+func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	host, port, err := net.SplitHostPort(cfg.Target)
+	if err != nil {
+		return nil, fmt.Errorf("tcp target must be host:port: %v", err)
+	}
+	ipv6, err := plugin.PreferIPv6(host, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &TCPProbe{
+		name:     cfg.Name,
+		target:   cfg.Target,
+		host:     host,
+		port:     port,
+		interval: cfg.Interval,
+		timeout:  timeout,
+		ipv6:     ipv6,
+		log:      plugin.ProbeLogger(cfg),
+	}, nil
+}
+
+func (p *TCPProbe) Name() string            { return p.name }
+func (p *TCPProbe) Interval() time.Duration { return p.interval }
+
+func (p *TCPProbe) Run(ctx context.Context) []plugin.Metric {
+	return []plugin.Metric{p.connect(ctx)}
+}
+
+// connect dials once and reports the handshake time. Name resolution is
+// done first so it is not counted in the connect time.
+func (p *TCPProbe) connect(ctx context.Context) plugin.Metric {
+	m := plugin.NewMetric(p.name, "tcp")
+	m.Tags[plugin.TagTarget] = p.target
+	m.Tags[plugin.TagFamily] = plugin.Family(p.ipv6)
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	ip, err := plugin.ResolveIP(ctx, p.host, p.ipv6)
+	if err != nil {
+		p.log.Warn("lookup failed", "host", p.host, "err", err)
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+	m.Tags[plugin.TagAddr] = ip.String()
+
+	network := "tcp4"
+	if p.ipv6 {
+		network = "tcp6"
+	}
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), p.port))
+	elapsed := time.Since(start)
+	if err != nil {
+		p.log.Warn("connect failed", "addr", ip, "port", p.port, "err", err)
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+	p.log.Debug("connected", "addr", ip, "port", p.port, "took", elapsed)
+	conn.Close()
+
+	m.Fields[plugin.FieldRTT] = elapsed.Seconds() * 1000
+	return m
+}
@@ -0,0 +1,106 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+)
+
+func run(t *testing.T, target string, timeout time.Duration) plugin.Metric {
+	t.Helper()
+	pr, err := New(plugin.ProbeConfig{Name: "test", Type: "tcp", Target: target, Interval: time.Minute, Timeout: timeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pr.Run(context.Background())[0]
+}
+
+func TestConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	m := run(t, ln.Addr().String(), time.Second)
+	if m.Status != plugin.StatusOK {
+		t.Fatalf("status %s: %s", m.Status, m.Error)
+	}
+	if _, ok := m.Fields[plugin.FieldRTT]; !ok {
+		t.Error("no rtt")
+	}
+	if m.Tags[plugin.TagAddr] != "127.0.0.1" || m.Tags[plugin.TagFamily] != "ipv4" {
+		t.Errorf("addr %q, family %q", m.Tags[plugin.TagAddr], m.Tags[plugin.TagFamily])
+	}
+}
+
+func TestRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	m := run(t, addr, time.Second)
+	if m.Status == plugin.StatusOK || m.Tags[plugin.TagFailure] != plugin.FailureRefused {
+		t.Errorf("status %s (%s), failure %q, want %q", m.Status, m.Error, m.Tags[plugin.TagFailure], plugin.FailureRefused)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, tt := range []struct{ name, target string }{
+		{"full backlog", fullListener(t)},
+		// TEST-NET-1 is not routed, unless the network refuses it itself
+		{"non-routable", "192.0.2.1:80"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			m := run(t, tt.target, 100*time.Millisecond)
+			if m.Status == plugin.StatusOK {
+				t.Fatal("connected")
+			}
+			if f := m.Tags[plugin.TagFailure]; tt.name == "non-routable" && (f == plugin.FailureRefused || f == plugin.FailureUnreachable) {
+				t.Skipf("the network rejects %s: %s", tt.target, m.Error)
+			}
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("took %s with a 100ms timeout", took)
+			}
+			if m.Tags[plugin.TagFailure] != plugin.FailureTimeout {
+				t.Errorf("failure %q (%s), want %q", m.Tags[plugin.TagFailure], m.Error, plugin.FailureTimeout)
+			}
+		})
+	}
+}
+
+// fullListener returns the address of a socket that never accepts and
+// whose backlog is full, so further handshakes never complete.
+func fullListener(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+	// a backlog of 0 still queues one connection
+	for i := 0; i < 2; i++ {
+		if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+			t.Cleanup(func() { conn.Close() })
+		}
+	}
+	return addr
+}
@@ -0,0 +1,251 @@
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"tokeping/pkg/logging"
+	"tokeping/pkg/plugin"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultPort    = "443"
+)
+
+// Fields and tags added by the tls probe. rtt is the handshake time,
+// without the TCP connect.
+const (
+	FieldConnect         = "connect"           // TCP connect time, ms
+	FieldExpiryDays      = "expiry_days"       // until the leaf certificate expires
+	FieldChainExpiryDays = "chain_expiry_days" // until the first certificate of the chain expires
+	FieldVerified        = "verified"          // 1 if the chain verifies against the system roots
+	FieldSANMatch        = "san_match"         // 1 if the leaf is valid for the server name
+	FieldOCSPStapled     = "ocsp_stapled"      // 1 if the server stapled an OCSP response
+	FieldChainLength     = "chain_length"      // certificates sent by the server
+
+	TagTLSVersion = "tls_version"
+	TagCipher     = "cipher"
+	TagIssuer     = "issuer"
+	TagServerName = "server_name"
+)
+
+var versions = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// TLSProbe connects to host:port, completes a TLS handshake and reports
+// its time together with the negotiated parameters and the state of the
+// server's certificate chain.
+type TLSProbe struct {
+	name       string
+	target     string
+	host       string
+	port       string
+	serverName string
+	skipVerify bool
+	interval   time.Duration
+	timeout    time.Duration
+	ipv6       bool
+	roots      *x509.CertPool // nil for the system roots
+	log        *logging.Logger
+}
+
+func init() {
+	plugin.RegisterProbe("tls", New)
+	plugin.RegisterProbeValidator("tls", validate)
+}
+
+func validate(cfg plugin.ProbeConfig) error {
+	host, _ := splitTarget(cfg.Target)
+	if host == "" {
+		return fmt.Errorf("tls target must be host or host:port")
+	}
+	return nil
+}
+
+// splitTarget splits host:port, defaulting to port 443.
+func splitTarget(target string) (host, port string) {
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		return host, port
+	}
+	return strings.Trim(target, "[]"), defaultPort
+}
+
+// New creates a TLSProbe for a "host:port" target; the port defaults to
+// 443 and the SNI name to the host, unless server_name is set.
+func New(cfg plugin.ProbeConfig) (plugin.Probe, error) {
+	host, port := splitTarget(cfg.Target)
+	ipv6, err := plugin.PreferIPv6(host, cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	serverName := cfg.ServerName
+	if serverName == "" && net.ParseIP(host) == nil {
+		serverName = host
+	}
+	return &TLSProbe{
+		name:       cfg.Name,
+		target:     cfg.Target,
+		host:       host,
+		port:       port,
+		serverName: serverName,
+		skipVerify: cfg.SkipVerify,
+		interval:   cfg.Interval,
+		timeout:    timeout,
+		ipv6:       ipv6,
+		log:        plugin.ProbeLogger(cfg),
+	}, nil
+}
+
+func (p *TLSProbe) Name() string            { return p.name }
+func (p *TLSProbe) Interval() time.Duration { return p.interval }
+
+func (p *TLSProbe) Run(ctx context.Context) []plugin.Metric {
+	return []plugin.Metric{p.handshake(ctx)}
+}
+
+// handshake connects once and reports the handshake and certificate
+// details. The chain is verified here rather than by crypto/tls so that
+// an expired or untrusted certificate still gets its fields recorded.
+func (p *TLSProbe) handshake(ctx context.Context) plugin.Metric {
+	m := plugin.NewMetric(p.name, "tls")
+	m.Tags[plugin.TagTarget] = p.target
+	m.Tags[plugin.TagFamily] = plugin.Family(p.ipv6)
+	if p.serverName != "" {
+		m.Tags[TagServerName] = p.serverName
+	}
+	fail := func(err error) plugin.Metric {
+		p.log.Warn("handshake failed", "target", p.target, "err", err)
+		m.Tags[plugin.TagFailure] = plugin.ClassifyError(err)
+		m.Fail(err)
+		return m
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	ip, err := plugin.ResolveIP(ctx, p.host, p.ipv6)
+	if err != nil {
+		return fail(err)
+	}
+	m.Tags[plugin.TagAddr] = ip.String()
+
+	network := "tcp4"
+	if p.ipv6 {
+		network = "tcp6"
+	}
+	var d net.Dialer
+	start := time.Now()
+	raw, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), p.port))
+	if err != nil {
+		return fail(err)
+	}
+	defer raw.Close()
+	m.Fields[FieldConnect] = time.Since(start).Seconds() * 1000
+
+	conn := tls.Client(raw, &tls.Config{
+		ServerName: p.serverName,
+		// verified below, so a bad chain is reported instead of just failing
+		InsecureSkipVerify: true,
+		// accept what old servers offer, to report it
+		MinVersion: tls.VersionTLS10,
+	})
+	start = time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return fail(err)
+	}
+	m.Fields[plugin.FieldRTT] = time.Since(start).Seconds() * 1000
+
+	state := conn.ConnectionState()
+	p.log.Debug("handshake done", "addr", ip, "version", versions[state.Version],
+		"cipher", tls.CipherSuiteName(state.CipherSuite), "certificates", len(state.PeerCertificates))
+	m.Tags[TagTLSVersion] = versions[state.Version]
+	m.Tags[TagCipher] = tls.CipherSuiteName(state.CipherSuite)
+	m.Fields[FieldOCSPStapled] = 0
+	if len(state.OCSPResponse) > 0 {
+		m.Fields[FieldOCSPStapled] = 1
+	}
+	if err := p.check(&m, state.PeerCertificates); err != nil {
+		p.log.Warn("certificate not acceptable", "target", p.target, "err", err)
+		m.Tags[plugin.TagFailure] = plugin.FailureUnexpected
+		m.Fail(err)
+	}
+	return m
+}
+
+// check records the certificate details of the chain the server sent in
+// m, and returns why the certificate is not acceptable, if it is not.
+func (p *TLSProbe) check(m *plugin.Metric, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	leaf := certs[0]
+	now := time.Now()
+	m.Fields[FieldChainLength] = float64(len(certs))
+	m.Fields[FieldExpiryDays] = days(leaf.NotAfter.Sub(now))
+	m.Tags[TagIssuer] = leaf.Issuer.CommonName
+	if m.Tags[TagIssuer] == "" {
+		m.Tags[TagIssuer] = leaf.Issuer.String()
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, verifyErr := leaf.Verify(x509.VerifyOptions{Roots: p.roots, Intermediates: intermediates, CurrentTime: now})
+	m.Fields[FieldVerified] = 0
+	chain := certs
+	if verifyErr == nil {
+		m.Fields[FieldVerified] = 1
+		chain = chains[0]
+	}
+	first := leaf.NotAfter
+	for _, c := range chain {
+		if c.NotAfter.Before(first) {
+			first = c.NotAfter
+		}
+	}
+	m.Fields[FieldChainExpiryDays] = days(first.Sub(now))
+
+	var sanErr error
+	if p.serverName != "" {
+		sanErr = leaf.VerifyHostname(p.serverName)
+	} else {
+		sanErr = leaf.VerifyHostname(p.host)
+	}
+	m.Fields[FieldSANMatch] = 1
+	if sanErr != nil {
+		m.Fields[FieldSANMatch] = 0
+	}
+
+	switch {
+	case now.After(leaf.NotAfter):
+		return fmt.Errorf("certificate expired %s", leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		return fmt.Errorf("certificate not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	case p.skipVerify:
+		return nil
+	case verifyErr != nil:
+		return verifyErr
+	case sanErr != nil:
+		return sanErr
+	}
+	return nil
+}
+
+func days(d time.Duration) float64 {
+	return d.Hours() / 24
+}
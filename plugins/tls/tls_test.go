@@ -0,0 +1,184 @@
+package tls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tokeping/pkg/plugin"
+)
+
+// certificate issues a certificate for names valid until notAfter, signed
+// by parent or self-signed if parent is nil.
+func certificate(t *testing.T, cn string, names []string, notAfter time.Time, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     names,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	if parent != nil {
+		cert.Certificate = append(cert.Certificate, parent.Certificate...)
+	}
+	return cert
+}
+
+// server serves cert over TLS and returns its address.
+func server(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	// the probe hangs up after the handshake
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func near(got, want float64) bool {
+	return math.Abs(got-want) < 0.01
+}
+
+func TestHandshake(t *testing.T) {
+	now := time.Now()
+	ca := certificate(t, "Test CA", nil, now.Add(10*24*time.Hour), nil)
+	leaf := certificate(t, "www.example.com", []string{"www.example.com"}, now.Add(30*24*time.Hour), &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	addr := server(t, leaf)
+
+	tests := []struct {
+		name       string
+		serverName string
+		skipVerify bool
+		roots      *x509.CertPool
+		err        string // "" for ok
+		verified   float64
+		sanMatch   float64
+	}{
+		{name: "verified", serverName: "www.example.com", roots: roots, verified: 1, sanMatch: 1},
+		{name: "san mismatch", serverName: "mail.example.com", roots: roots, verified: 1,
+			err: "x509: certificate is valid for www.example.com, not mail.example.com"},
+		{name: "untrusted", serverName: "www.example.com", verified: 0, sanMatch: 1,
+			err: "x509: certificate signed by unknown authority"},
+		{name: "skip verify", serverName: "mail.example.com", skipVerify: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pr, err := New(plugin.ProbeConfig{
+				Name:       "test",
+				Type:       "tls",
+				Target:     addr,
+				Interval:   time.Minute,
+				Timeout:    time.Second,
+				ServerName: tt.serverName,
+				SkipVerify: tt.skipVerify,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pr.(*TLSProbe).roots = tt.roots
+			m := pr.Run(context.Background())[0]
+
+			if tt.err == "" && m.Status != plugin.StatusOK {
+				t.Errorf("status %s: %s", m.Status, m.Error)
+			}
+			if tt.err != "" {
+				if m.Status == plugin.StatusOK || m.Error != tt.err {
+					t.Errorf("status %s, error %q, want %q", m.Status, m.Error, tt.err)
+				}
+				if m.Tags[plugin.TagFailure] != plugin.FailureUnexpected {
+					t.Errorf("failure %q, want %q", m.Tags[plugin.TagFailure], plugin.FailureUnexpected)
+				}
+			}
+			if m.Fields[FieldVerified] != tt.verified || m.Fields[FieldSANMatch] != tt.sanMatch {
+				t.Errorf("verified %v, san_match %v, want %v, %v",
+					m.Fields[FieldVerified], m.Fields[FieldSANMatch], tt.verified, tt.sanMatch)
+			}
+			if !near(m.Fields[FieldExpiryDays], 30) {
+				t.Errorf("expiry_days %v, want 30", m.Fields[FieldExpiryDays])
+			}
+			// the CA sent along expires first
+			if !near(m.Fields[FieldChainExpiryDays], 10) {
+				t.Errorf("chain_expiry_days %v, want 10", m.Fields[FieldChainExpiryDays])
+			}
+			if m.Tags[TagIssuer] != "Test CA" || m.Fields[FieldChainLength] != 2 {
+				t.Errorf("issuer %q, chain_length %v", m.Tags[TagIssuer], m.Fields[FieldChainLength])
+			}
+			if m.Tags[TagTLSVersion] != "1.3" || m.Tags[TagServerName] != tt.serverName {
+				t.Errorf("tls_version %q, server_name %q", m.Tags[TagTLSVersion], m.Tags[TagServerName])
+			}
+		})
+	}
+}
+
+func TestExpired(t *testing.T) {
+	cert := certificate(t, "old", []string{"old.example.com"}, time.Now().Add(-24*time.Hour), nil)
+	pr, err := New(plugin.ProbeConfig{
+		Name:       "test",
+		Type:       "tls",
+		Target:     server(t, cert),
+		Interval:   time.Minute,
+		Timeout:    time.Second,
+		ServerName: "old.example.com",
+		SkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pr.Run(context.Background())[0]
+	// skip_verify does not excuse an expired certificate
+	if m.Status == plugin.StatusOK || !near(m.Fields[FieldExpiryDays], -1) {
+		t.Errorf("status %s (%s), expiry_days %v", m.Status, m.Error, m.Fields[FieldExpiryDays])
+	}
+}
+
+func TestRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	pr, err := New(plugin.ProbeConfig{Name: "test", Type: "tls", Target: addr, Interval: time.Minute, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := pr.Run(context.Background())[0]
+	if m.Status == plugin.StatusOK || m.Tags[plugin.TagFailure] != plugin.FailureRefused {
+		t.Errorf("status %s, failure %q", m.Status, m.Tags[plugin.TagFailure])
+	}
+}
@@ -1,12 +1,14 @@
 package ws
 
 import (
-    "fmt"
-    "os"
+    "context"
+    "errors"
     "net/http"
     "sync"
+    "time"
 
     "github.com/gorilla/websocket"
+    "tokeping/pkg/logging"
     "tokeping/pkg/plugin"
 )
 
@@ -15,16 +17,25 @@ type WSOutput struct {
     clients  map[*websocket.Conn]bool
     mu       sync.Mutex
     upgrader websocket.Upgrader
+    server   *http.Server
+    log      *logging.Logger
 }
 
 func init() {
     plugin.RegisterOutput("ws", New)
+    plugin.RegisterOutputValidator("ws", func(cfg plugin.OutputConfig) error {
+        if cfg.Listen == "" {
+            return errors.New("ws output needs a listen address")
+        }
+        return nil
+    })
 }
 
 func New(cfg plugin.OutputConfig) (plugin.Output, error) {
     return &WSOutput{
         addr:    cfg.Listen,
         clients: make(map[*websocket.Conn]bool),
+        log:     logging.New("ws").With("output", cfg.Name),
         upgrader: websocket.Upgrader{
             CheckOrigin: func(r *http.Request) bool { return true },
         },
@@ -33,14 +44,17 @@ func New(cfg plugin.OutputConfig) (plugin.Output, error) {
 
 func (w *WSOutput) Name() string { return "ws" }
 func (w *WSOutput) Start() error {
+    // own mux so the output can be stopped and started again on reload
+    mux := http.NewServeMux()
     // serve static UI too
-    http.Handle("/", http.FileServer(http.Dir("web/static")))
-    http.HandleFunc("/ws", w.handleWS)
+    mux.Handle("/", http.FileServer(http.Dir("web/static")))
+    mux.HandleFunc("/ws", w.handleWS)
+    w.server = &http.Server{Addr: w.addr, Handler: mux}
 
-    fmt.Printf("🌐  HTTP/ws server listening on %s\n", w.addr)
+    w.log.Info("HTTP/ws server listening", "listen", w.addr)
     go func() {
-        if err := http.ListenAndServe(w.addr, nil); err != nil {
-            fmt.Fprintf(os.Stderr, "❌ HTTP server error: %v\n", err)
+        if err := w.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            w.log.Error("HTTP server failed", "listen", w.addr, "err", err)
         }
     }()
     return nil
@@ -64,9 +78,15 @@ func (w *WSOutput) Send(m plugin.Metric) {
 }
 func (w *WSOutput) Stop() error {
     w.mu.Lock()
-    defer w.mu.Unlock()
     for c := range w.clients {
         c.Close()
+        delete(w.clients, c)
     }
-    return nil
+    w.mu.Unlock()
+    if w.server == nil {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    return w.server.Shutdown(ctx)
 }
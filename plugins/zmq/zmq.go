@@ -2,6 +2,7 @@ package zmq
 
 import (
     "encoding/json"
+    "errors"
 
     zmq "github.com/pebbe/zmq4"
     "tokeping/pkg/plugin"
@@ -13,6 +14,12 @@ type ZMQOutput struct {
 
 func init() {
     plugin.RegisterOutput("zmq", New)
+    plugin.RegisterOutputValidator("zmq", func(cfg plugin.OutputConfig) error {
+        if cfg.Listen == "" {
+            return errors.New("zmq output needs a listen address")
+        }
+        return nil
+    })
 }
 
 func New(cfg plugin.OutputConfig) (plugin.Output, error) {
@@ -4,9 +4,12 @@ const chart = new Chart(ctx, { type: 'line', data, options: { animation: false,
 const ws = new WebSocket(`ws://${window.location.host}/ws`);
 ws.onmessage = e => {
     const m = JSON.parse(e.data);
-    const label = new Date(m.Time * 1000).toLocaleTimeString();
+    // events such as path changes are not latency samples
+    if (m.tags && m.tags.event) return;
+    const label = new Date(m.time / 1e6).toLocaleTimeString();
     chart.data.labels.push(label);
-    chart.data.datasets[0].data.push(m.Latency);
+    // failed runs have no rtt; leave a gap in the line
+    chart.data.datasets[0].data.push(m.status === 'ok' && m.fields ? m.fields.rtt : null);
     if (chart.data.labels.length > 50) {
         chart.data.labels.shift();
         chart.data.datasets[0].data.shift();